@@ -0,0 +1,191 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/*
+	Callback function declaration for nodes that expect a press of an inline button
+	The endpoint returns the next node just like a regular endpoint does
+*/
+type ButtonCallback func(e *Node, cb *tb.Callback) *Node
+
+/*
+	Makes the node expect a callback of an inline button instead of a message, see Chain.ProcessCallback
+*/
+func (e *Node) ExpectCallback(endpoint ButtonCallback) *Node {
+	e.event = tb.OnCallback
+	e.onCallback = endpoint
+	return e
+}
+
+/*
+	Makes the node store the parameters of the callback data as the user data, see ParseCallbackData
+*/
+func (e *Node) StoreCallbackParams(enabled bool) *Node {
+	e.storeParams = enabled
+	return e
+}
+
+/*
+	Parses callback data of the "key=value;key=value" form, values are URL-escaped
+	The unique prefix telebot adds to the data of buttons with a unique name is skipped.
+	Malformed data results in an empty map
+*/
+func ParseCallbackData(data string) map[string]string {
+	params := make(map[string]string)
+	if strings.HasPrefix(data, "\f") {
+		if i := strings.Index(data, "|"); i >= 0 {
+			data = data[i+1:]
+		} else {
+			return params
+		}
+	}
+	if data == "" {
+		return params
+	}
+	for _, pair := range strings.Split(data, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return make(map[string]string)
+		}
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return make(map[string]string)
+		}
+		params[kv[0]] = value
+	}
+	return params
+}
+
+/*
+	Builds callback data of the form ParseCallbackData understands, keys are sorted
+*/
+func EncodeCallbackData(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + url.QueryEscape(params[key])
+	}
+	return strings.Join(pairs, ";")
+}
+
+/*
+	Processes a press of an inline button by a user on a node that expects a callback, see Node.ExpectCallback
+	Returns false if the user is not in the flow or the node doesn't expect a callback
+*/
+func (c *Chain) ProcessCallback(cb *tb.Callback) bool {
+	if cb == nil || cb.Sender == nil || c.isClosed() {
+		return false
+	}
+	if cb.Message != nil && !c.settings().allowsChat(cb.Message.Chat) {
+		return false
+	}
+	sender := c.callbackKeyOf(cb)
+	node, ok := c.GetPosition(sender)
+	if !ok || node == nil || !c.contains(node) || node.onCallback == nil {
+		return false
+	}
+	if paused, text := c.pauseOf(sender); paused {
+		c.answerCallback(sender, node, cb, &tb.CallbackResponse{Text: text})
+		return false
+	}
+	c.touch(sender)
+	if allowed, reason := c.admits(sender, callbackMessage(cb)); !allowed {
+		c.answerCallback(sender, node, cb, &tb.CallbackResponse{Text: reason})
+		return false
+	}
+	if node.storeParams {
+		for key, value := range ParseCallbackData(cb.Data) {
+			c.SetData(sender, key, value)
+		}
+	}
+	c.mx.Lock()
+	c.responded[cb.ID] = false
+	// the answered callbacks are not a part of the settings, there's nothing to publish
+	c.mx.Unlock()
+	c.transit(c.settings(), c.GetBot(), sender, nil, node, node.onCallback(node, cb))
+	c.mx.Lock()
+	responded, responder := c.responded[cb.ID], c.responder
+	delete(c.responded, cb.ID)
+	c.mx.Unlock()
+	if !responded {
+		// telegram clients show a spinner until a callback is answered
+		var resp *tb.CallbackResponse
+		if responder != nil {
+			resp = responder(node, cb)
+		}
+		c.answerCallback(sender, node, cb, resp)
+	}
+	return true
+}
+
+/*
+	Answers a callback on behalf of the flow, a nil response is an empty answer
+*/
+func (c *Chain) answerCallback(sender tb.Recipient, node *Node, cb *tb.Callback, resp *tb.CallbackResponse) {
+	if c.intercept(OutgoingMessage{Action: ActionRespond, Recipient: sender.Recipient(), Node: node, What: resp}) {
+		return
+	}
+	if resp != nil {
+		c.GetBot().Respond(cb, resp)
+	} else {
+		c.GetBot().Respond(cb)
+	}
+}
+
+/*
+	Gets a message with the sender and the chat of a callback, e.g. for the functions that expect messages
+*/
+func callbackMessage(cb *tb.Callback) *tb.Message {
+	m := &tb.Message{Sender: cb.Sender}
+	if cb.Message != nil {
+		m.Chat = cb.Message.Chat
+	}
+	return m
+}
+
+/*
+	Sets a function that builds the answer to a callback processed by the flow, e.g. to show a toast
+	Callbacks are answered automatically after processing, an empty answer is sent when the function is not set
+	or returns nil
+*/
+func (c *Chain) SetCallbackResponse(responder func(node *Node, cb *tb.Callback) *tb.CallbackResponse) *Chain {
+	c.mx.Lock()
+	c.responder = responder
+	c.unlock()
+	return c
+}
+
+/*
+	Answers a callback on behalf of the flow
+	Endpoints should use it instead of answering with the bot, so that the callback is not answered twice
+*/
+func (c *Chain) Respond(cb *tb.Callback, resp ...*tb.CallbackResponse) error {
+	var what interface{}
+	if len(resp) > 0 {
+		what = resp[0]
+	}
+	recipient := ""
+	if cb.Sender != nil {
+		recipient = cb.Sender.Recipient()
+	}
+	if !c.intercept(OutgoingMessage{Action: ActionRespond, Recipient: recipient, What: what}) {
+		if err := c.GetBot().Respond(cb, resp...); err != nil {
+			return err
+		}
+	}
+	c.mx.Lock()
+	if _, ok := c.responded[cb.ID]; ok {
+		c.responded[cb.ID] = true
+	}
+	c.mx.Unlock()
+	return nil
+}
@@ -0,0 +1,75 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+	"time"
+)
+
+/*
+	Creates a flow with a first node that advances on any button
+*/
+func newButtonFlow(t *testing.T) *Chain {
+	t.Helper()
+	flow := newTestFlow(t, "first", "second")
+	first, _ := flow.Search("first")
+	first.ExpectCallback(func(e *Node, cb *tb.Callback) *Node {
+		return e.Next()
+	})
+	return flow
+}
+
+/*
+	Creates a press of an inline button by a user
+*/
+func pressOf(user *tb.User) *tb.Callback {
+	return &tb.Callback{ID: "cb", Sender: user, Message: &tb.Message{Chat: &tb.Chat{ID: int64(user.ID), Type: tb.ChatPrivate}}}
+}
+
+func TestPreconditionGatesCallbacks(t *testing.T) {
+	flow := newButtonFlow(t)
+	user := &tb.User{ID: 1}
+	flow.SetPrecondition(func(recipient tb.Recipient, m *tb.Message) (bool, string) {
+		return false, "suspended"
+	})
+	var answers []OutgoingMessage
+	flow.OnSuppressed(func(msg OutgoingMessage) {
+		if msg.Action == ActionRespond {
+			answers = append(answers, msg)
+		}
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if flow.ProcessCallback(pressOf(user)) {
+		t.Error("a denied callback was processed")
+	}
+	if id := positionOf(flow, user); id != "first" {
+		t.Errorf("expected the user to stay on first, got %q", id)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("expected the callback answered once, got %d answers", len(answers))
+	}
+	if resp, _ := answers[0].What.(*tb.CallbackResponse); resp == nil || resp.Text != "suspended" {
+		t.Errorf("expected the reason in the answer, got %+v", answers[0].What)
+	}
+}
+
+func TestPausedUserCantPressButtons(t *testing.T) {
+	flow := newButtonFlow(t)
+	user := &tb.User{ID: 1}
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.PauseFor(user, time.Hour)
+	if flow.ProcessCallback(pressOf(user)) {
+		t.Error("a callback of a paused user was processed")
+	}
+	if id := positionOf(flow, user); id != "first" {
+		t.Errorf("expected the user to stay on first, got %q", id)
+	}
+	flow.PauseFor(user, 0)
+	if !flow.ProcessCallback(pressOf(user)) {
+		t.Error("a callback was not processed after the pause")
+	}
+}
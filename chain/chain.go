@@ -9,7 +9,10 @@ package chain
 import (
 	"github.com/pkg/errors"
 	tb "gopkg.in/tucnak/telebot.v2"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -20,12 +23,131 @@ type Chain struct {
 	root           *Node
 	bot            *tb.Bot
 	defaultLocale  string
-	positions      map[string]*Node
+	shards         []*shard
 	defaultHandler Callback
+	onCancel       UserCallback
+	onComplete     UserCallback
+	defaultOptions *tb.SendOptions
+	transparent    map[string]bool
+	restartPolicy  RestartPolicy
+	onRestart      UserCallback
+	stuckAttempts  int
+	onStuck        StuckCallback
+	timeout        time.Duration
+	onTimeout      UserCallback
+	onNodeTimeout  UserCallback
+	reaper         chan struct{}
+	autoPrompt     bool
+	onAdvance      AdvanceCallback
+	onMissingNode  func(recipient tb.Recipient) *Node
+	codec          Codec
+	summary        func(recipient tb.Recipient, state map[string]interface{}) string
+	maxTransitions int
+	onLoopDetected UserCallback
+	intro          *message
+	end            *Node
+	chatTypes      map[tb.ChatType]bool
+	closed         bool
+	maxSessions    int
+	transformer    func(recipient tb.Recipient, node *Node, text string) string
+	confirmYes     TextFunc
+	confirmNo      TextFunc
+	invalidInput   TextFunc
+	inFlight       InFlightPolicy
+	responded      map[string]bool
+	responder      func(node *Node, cb *tb.Callback) *tb.CallbackResponse
+	trigger        string
+	precondition   func(recipient tb.Recipient, m *tb.Message) (bool, string)
+	onPosition     PositionCallback
+	deletePrevious bool
+	outgoing       func(msg OutgoingMessage)
+	onDuration     func(flowId, nodeId string, d time.Duration)
+	onCompleteData func(recipient string, data map[string]interface{})
+	passthrough    Guard
+	pauseMessage   func(recipient tb.Recipient, until time.Time) string
+	updateFilter   Guard
+	dryRun         bool
+	onSuppressed   func(msg OutgoingMessage)
+	helpTriggers   map[string]bool
+	defaultHelp    string
+	trackHistory   bool
+	onAudit        func(recipient tb.Recipient, last *Node, state map[string]interface{}, history []string)
+	keyFunc        func(m *tb.Message) string
+	callbackKey    func(cb *tb.Callback) string
+	repeatComplete *message
+	alreadyDone    func(recipient tb.Recipient, m *tb.Message)
+	onEvict        func(recipient string, reason EvictReason)
+	values         map[string]interface{}
+	onStart        UserCallback
+	totals         counters
+	current        atomic.Value
 	mx             sync.RWMutex
 }
 
-var ErrChainIsEmpty = errors.New("chain has zero handlers")
+/*
+	Restart policy defines what happens when a flow is started for a user that is already in it
+*/
+type RestartPolicy int
+
+const (
+	Overwrite RestartPolicy = iota // the user starts over, the previous progress is lost
+	Ignore                         // the start is refused with ErrAlreadyStarted
+	Confirm                        // the start is refused and the restart callback decides what to do
+)
+
+/*
+	Callback function declaration for an event that happens to a user at a "node"
+*/
+type UserCallback func(recipient tb.Recipient, last *Node)
+
+/*
+	Callback function declaration for a user that got stuck on a "node" after a number of attempts
+*/
+type StuckCallback func(node *Node, recipient string, attempts int)
+
+/*
+	Callback function declaration for a user whose position has changed from one node to another
+*/
+type PositionCallback func(recipient string, from, to *Node)
+
+/*
+	Callback function declaration for a user moving between two nodes because of a message
+	The message is nil when the user has moved because of an inline query or a callback
+*/
+type AdvanceCallback func(from, to *Node, m *tb.Message)
+
+var (
+	ErrChainIsEmpty       = errors.New("chain has zero handlers")
+	ErrFinishWithEndpoint = errors.New("finishing node has an endpoint")
+	ErrNodeNotFound       = errors.New("node does not exist")
+	ErrDuplicateNode      = errors.New("node already exists")
+	ErrUserNotInFlow      = errors.New("user is not in the flow")
+	ErrNoPrompt           = errors.New("node has no prompt")
+	ErrAlreadyStarted     = errors.New("user is already in the flow")
+	ErrNoPromptMessage    = errors.New("no prompt has been sent to the user")
+	ErrNoDynamicPrompt    = errors.New("node has no text function")
+	ErrFlowClosed         = errors.New("flow is closed")
+)
+
+/*
+	An error for a node that doesn't exist in the chain carrying the node ID
+	It matches ErrNodeNotFound with errors.Is, errors.Cause returns ErrNodeNotFound as well
+*/
+type NodeNotFoundError struct {
+	NodeId string
+}
+
+func (e *NodeNotFoundError) Error() string {
+	return e.NodeId + ": " + ErrNodeNotFound.Error()
+}
+
+func (e *NodeNotFoundError) Unwrap() error {
+	return ErrNodeNotFound
+}
+
+func (e *NodeNotFoundError) Cause() error {
+	return ErrNodeNotFound
+}
 
 /*
 	Creates a new chain flow
@@ -34,14 +156,138 @@ func NewChainFlow(id string, bot *tb.Bot) (*Chain, error) {
 	f := &Chain{
 		id:             id,
 		bot:            bot,
-		positions:      make(map[string]*Node),
+		shards:         newShards(1),
 		defaultHandler: nil,
+		maxTransitions: 100,
+		responded:      make(map[string]bool),
 		mx:             sync.RWMutex{},
 	}
 	f.root = &Node{id: id + "_root", flow: f, endpoint: nil, prev: nil, next: nil}
+	f.end = &Node{id: id + "_end", flow: f, end: true}
+	f.publish()
+	return f, nil
+}
+
+/*
+	A definition of a single stage of a linear chain
+*/
+type Step struct {
+	Id      string
+	Prompt  string
+	Handler Callback
+	Event   string
+}
+
+/*
+	Creates a new chain flow with the stages linked one after another in the provided order
+	Steps with a prompt get it configured on their nodes, see Node.SetPrompt
+*/
+func NewLinearFlow(flowId string, bot *tb.Bot, steps []Step) (*Chain, error) {
+	f, err := NewChainFlow(flowId, bot)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(steps))
+	node := f.root
+	for _, step := range steps {
+		if ids[step.Id] {
+			return nil, errors.Wrap(ErrDuplicateNode, step.Id)
+		}
+		ids[step.Id] = true
+		node = node.Then(step.Id, step.Handler, step.Event)
+		if step.Prompt != "" {
+			node.SetPrompt(step.Prompt)
+		}
+	}
 	return f, nil
 }
 
+/*
+	Creates a deep copy of the chain with a new identificator
+	Nodes are copied along with their links, the bot is shared and positions start empty
+*/
+func (c *Chain) Clone(newFlowId string) *Chain {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	f := &Chain{
+		id:             newFlowId,
+		bot:            c.bot,
+		defaultLocale:  c.defaultLocale,
+		shards:         newShards(len(c.shards)),
+		defaultHandler: c.defaultHandler,
+		onCancel:       c.onCancel,
+		onComplete:     c.onComplete,
+		defaultOptions: c.defaultOptions,
+		transparent:    c.transparent,
+		restartPolicy:  c.restartPolicy,
+		onRestart:      c.onRestart,
+		stuckAttempts:  c.stuckAttempts,
+		onStuck:        c.onStuck,
+		timeout:        c.timeout,
+		onTimeout:      c.onTimeout,
+		onNodeTimeout:  c.onNodeTimeout,
+		autoPrompt:     c.autoPrompt,
+		onAdvance:      c.onAdvance,
+		onMissingNode:  c.onMissingNode,
+		codec:          c.codec,
+		summary:        c.summary,
+		maxTransitions: c.maxTransitions,
+		onLoopDetected: c.onLoopDetected,
+		intro:          c.intro,
+		chatTypes:      c.chatTypes,
+		maxSessions:    c.maxSessions,
+		transformer:    c.transformer,
+		confirmYes:     c.confirmYes,
+		confirmNo:      c.confirmNo,
+		invalidInput:   c.invalidInput,
+		inFlight:       c.inFlight,
+		responded:      make(map[string]bool),
+		responder:      c.responder,
+		trigger:        c.trigger,
+		precondition:   c.precondition,
+		onPosition:     c.onPosition,
+		deletePrevious: c.deletePrevious,
+		onDuration:     c.onDuration,
+		onCompleteData: c.onCompleteData,
+		passthrough:    c.passthrough,
+		pauseMessage:   c.pauseMessage,
+		updateFilter:   c.updateFilter,
+		dryRun:         c.dryRun,
+		onSuppressed:   c.onSuppressed,
+		helpTriggers:   c.helpTriggers,
+		defaultHelp:    c.defaultHelp,
+		trackHistory:   c.trackHistory,
+		onAudit:        c.onAudit,
+		keyFunc:        c.keyFunc,
+		callbackKey:    c.callbackKey,
+		repeatComplete: c.repeatComplete,
+		alreadyDone:    c.alreadyDone,
+		onEvict:        c.onEvict,
+		values:         c.values,
+		onStart:        c.onStart,
+		mx:             sync.RWMutex{},
+	}
+	f.root = &Node{id: newFlowId + "_root", flow: f, endpoint: nil, prev: nil, next: nil}
+	f.end = &Node{id: newFlowId + "_end", flow: f, end: true}
+	copies := map[*Node]*Node{c.root: f.root, c.end: f.end}
+	prev := f.root
+	for node := c.root.next; node != nil; node = node.next {
+		copied := *node
+		copied.flow = f
+		copied.prev = prev
+		copied.next = nil
+		prev.next = &copied
+		prev = &copied
+		copies[node] = &copied
+	}
+	// links to other nodes must point to the copies as well
+	for _, copied := range copies {
+		copied.relink(copies)
+	}
+	f.publish()
+	return f
+}
+
 /*
 	Get chain's unique identificator
 */
@@ -53,7 +299,27 @@ func (c *Chain) GetId() string {
 	Get attached Telegram bot
 */
 func (c *Chain) GetBot() *tb.Bot {
-	return c.bot
+	return c.settings().bot
+}
+
+/*
+	Replaces the attached Telegram bot, e.g. after a token rotation
+	Messages that are being sent keep using the bot they have started with
+*/
+func (c *Chain) SetBot(bot *tb.Bot) *Chain {
+	c.mx.Lock()
+	c.bot = bot
+	c.unlock()
+	return c
+}
+
+/*
+	Gets a sentinel node that completes the flow right away
+	Return it from an endpoint or use it as a branch target to finish the flow early,
+	the summary is sent and OnComplete fires within the same Process call
+*/
+func (c *Chain) End() *Node {
+	return c.end
 }
 
 /*
@@ -63,101 +329,1834 @@ func (c *Chain) GetRoot() *Node {
 	return c.root
 }
 
+/*
+	Stores a flow-wide value by key, e.g. a database handle or a feature flag the endpoints need
+	Unlike the user data it's shared by all the users, endpoints reach it with node.GetFlow().GetContext(key).
+	Clones of the flow get the values as well
+*/
+func (c *Chain) SetContext(key string, value interface{}) *Chain {
+	c.mx.Lock()
+	// the values are copied on write, so the clones sharing them are not affected
+	values := make(map[string]interface{}, len(c.values)+1)
+	for k, v := range c.values {
+		values[k] = v
+	}
+	values[key] = value
+	c.values = values
+	c.unlock()
+	return c
+}
+
+/*
+	Retrieves a flow-wide value stored by key, see SetContext
+*/
+func (c *Chain) GetContext(key string) (interface{}, bool) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
 /*
 	Gets the user position in the flow
 */
 func (c *Chain) GetPosition(of tb.Recipient) (*Node, bool) {
-	c.mx.RLock()
-	node, ok := c.positions[of.Recipient()]
-	c.mx.RUnlock()
-	return node, ok
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return nil, false
+	}
+	return s.node, true
+}
+
+/*
+	Gets the ID of the node the user is on, e.g. for logging
+	The ID is empty for a user who is kept with no node, see SetRepeatCompleteMessage
+*/
+func (c *Chain) GetPositionID(of tb.Recipient) (string, bool) {
+	node, ok := c.GetPosition(of)
+	if !ok || node == nil {
+		return "", ok
+	}
+	return node.id, true
 }
 
 /*
 	Sets the user current position in the flow
 */
 func (c *Chain) SetPosition(of tb.Recipient, node *Node) {
+	track := c.tracksHistory()
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		from := s.node
+		if from != node {
+			s.arrive(node)
+		}
+		sh.touch(of.Recipient(), s)
+		sh.mx.Unlock()
+		if from != node {
+			c.totals.addReached(node)
+			c.positionChanged(of.Recipient(), from, node)
+		}
+		return
+	}
+	sh.put(of.Recipient(), newSession(node, track))
+	sh.mx.Unlock()
+	c.totals.addReached(node)
+	c.evictOver(of.Recipient())
+}
+
+/*
+	Moves everyone who is on a node with ID to another node, e.g. to relocate users stuck because of a bug
+	Returns the number of moved users, OnPositionChanged fires for each of them
+*/
+func (c *Chain) MoveAll(fromNodeId, toNodeId string) (int, error) {
+	from, ok := c.Search(fromNodeId)
+	if !ok {
+		return 0, &NodeNotFoundError{NodeId: fromNodeId}
+	}
+	to, ok := c.Search(toNodeId)
+	if !ok {
+		return 0, &NodeNotFoundError{NodeId: toNodeId}
+	}
+	if from == to {
+		return 0, nil
+	}
+	var moved []string
+	for _, sh := range c.getShards() {
+		sh.mx.Lock()
+		for key, s := range sh.sessions {
+			if s.node == from {
+				s.arrive(to)
+				moved = append(moved, key)
+			}
+		}
+		sh.mx.Unlock()
+	}
+	for _, key := range moved {
+		c.totals.addReached(to)
+		c.positionChanged(key, from, to)
+	}
+	return len(moved), nil
+}
+
+/*
+	Sets a callback that triggers when the position of a user changes, either by the flow or with SetPosition and MoveAll
+*/
+func (c *Chain) OnPositionChanged(callback PositionCallback) *Chain {
 	c.mx.Lock()
-	c.positions[of.Recipient()] = node
-	c.mx.Unlock()
+	c.onPosition = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Fires the position callback
+*/
+func (c *Chain) positionChanged(recipient string, from, to *Node) {
+	onPosition := c.settings().onPosition
+	if onPosition != nil {
+		onPosition(recipient, from, to)
+	}
 }
 
 /*
-	Deletes the user current position in the flow
+	Deletes the user current position in the flow along with the collected data
 */
 func (c *Chain) DeletePosition(of tb.Recipient) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	sh.remove(of.Recipient())
+	sh.mx.Unlock()
+}
+
+/*
+	Removes the user from the flow and fires the cancel callback
+	Returns true only if the user had a position in the flow
+*/
+func (c *Chain) Cancel(of tb.Recipient) bool {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	s, ok := sh.remove(of.Recipient())
+	sh.mx.Unlock()
+	if ok {
+		c.totals.addCancelled(1)
+	}
+	c.mx.RLock()
+	onCancel := c.onCancel
+	c.mx.RUnlock()
+	if ok && onCancel != nil {
+		onCancel(of, s.node)
+	}
+	return ok
+}
+
+/*
+	Cancels all the users matching the predicate and optionally sends them a notification
+	The predicate is called while the users are locked, so it must not call the flow methods
+	Returns the number of cancelled users
+*/
+func (c *Chain) CancelWhere(predicate func(node *Node, recipient string) bool, notify string) int {
+	type cancelled struct {
+		to   tb.Recipient
+		node *Node
+	}
+	var matched []cancelled
+	for _, sh := range c.getShards() {
+		sh.mx.Lock()
+		for key, s := range sh.sessions {
+			if predicate(s.node, key) {
+				sh.remove(key)
+				matched = append(matched, cancelled{to: recipientId(key), node: s.node})
+			}
+		}
+		sh.mx.Unlock()
+	}
+	c.totals.addCancelled(len(matched))
+	c.mx.RLock()
+	onCancel := c.onCancel
+	c.mx.RUnlock()
+	for _, user := range matched {
+		if notify != "" {
+			c.send(user.to, user.node, notify)
+		}
+		if onCancel != nil {
+			onCancel(user.to, user.node)
+		}
+	}
+	return len(matched)
+}
+
+/*
+	Sets a callback that triggers when a user begins the flow, it gets the node the user starts on
+	It fires once per successful start of any kind, after the position is set and not when the initial send fails
+*/
+func (c *Chain) OnStart(callback UserCallback) *Chain {
 	c.mx.Lock()
-	delete(c.positions, of.Recipient())
-	c.mx.Unlock()
+	c.onStart = callback
+	c.unlock()
+	return c
 }
 
 /*
-	Search for a node with ID
+	Counts a successful start and fires the start callback
 */
-func (c *Chain) Search(nodeId string) (*Node, bool) {
-	return c.root.SearchDown(nodeId)
+func (c *Chain) started(to tb.Recipient, first *Node) {
+	c.totals.addStarted(1)
+	c.mx.RLock()
+	onStart := c.onStart
+	c.mx.RUnlock()
+	if onStart != nil {
+		onStart(to, first)
+	}
 }
 
 /*
-	Get the root node
+	Sets a callback that triggers when a user is cancelled from the flow
 */
-func (c *Chain) SetDefaultHandler(endpoint Callback) *Chain {
-	c.defaultHandler = endpoint
+func (c *Chain) OnCancel(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onCancel = callback
+	c.unlock()
 	return c
 }
 
 /*
-	Executes the chain for the user by putting him on a first stage of the chain
+	Sets a callback that triggers when a user completes the flow
 */
-func (c *Chain) Start(to tb.Recipient, text string, options ...interface{}) (err error) {
-	if c.root.next == nil {
-		return ErrChainIsEmpty
+func (c *Chain) OnComplete(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onComplete = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that receives the last node, the collected data and the IDs of the visited nodes
+	once the user completes the flow, e.g. to persist an audit record. The history is nil unless
+	the flow tracks it, see SetTrackHistory. It fires after OnCompleteData and receives the same copy of the data
+*/
+func (c *Chain) OnCompleteWithHistory(callback func(recipient tb.Recipient, last *Node, state map[string]interface{}, history []string)) *Chain {
+	c.mx.Lock()
+	c.onAudit = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Makes the flow record the IDs of the nodes every user visits, it's disabled by default
+	Only the users that join the flow after it's enabled are tracked
+*/
+func (c *Chain) SetTrackHistory(enabled bool) *Chain {
+	c.mx.Lock()
+	c.trackHistory = enabled
+	c.unlock()
+	return c
+}
+
+/*
+	Checks if the flow records the visited nodes
+*/
+func (c *Chain) tracksHistory() bool {
+	return c.settings().trackHistory
+}
+
+/*
+	Sets a callback that receives all the data the user has collected once the user completes the flow
+	It fires after the user has been removed from the flow and after OnComplete,
+	the data is a copy taken at the removal, so it's safe to keep it
+*/
+func (c *Chain) OnCompleteData(callback func(recipient string, data map[string]interface{})) *Chain {
+	c.mx.Lock()
+	c.onCompleteData = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a message that is sent to a user who writes after completing the flow while the user is still kept
+	with no node, e.g. set with SetPosition(of, nil) from OnComplete to report the completion later.
+	A user who completes the flow is removed as usual, so the later messages are NotActive.
+	A kept user with no node is removed by the next message unless the message or OnAlreadyComplete is set,
+	otherwise the user stays kept as a completed one and every message gets the Finished outcome
+*/
+func (c *Chain) SetRepeatCompleteMessage(text string, options ...interface{}) *Chain {
+	c.mx.Lock()
+	c.repeatComplete = &message{text: text, options: options}
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers when a user writes after completing the flow, see SetRepeatCompleteMessage
+*/
+func (c *Chain) OnAlreadyComplete(callback func(recipient tb.Recipient, m *tb.Message)) *Chain {
+	c.mx.Lock()
+	c.alreadyDone = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Handles a message of a user who has completed the flow but is still kept with no node
+*/
+func (c *Chain) repeatCompleted(bot *tb.Bot, of tb.Recipient, m *tb.Message) ProcessResult {
+	c.mx.RLock()
+	repeat, alreadyDone := c.repeatComplete, c.alreadyDone
+	c.mx.RUnlock()
+	if repeat == nil && alreadyDone == nil {
+		c.DeletePosition(of)
+		return ProcessResult{Outcome: NotActive}
 	}
-	if options != nil && len(options) > 0 {
-		// a workaround for nil options
-		// otherwise the message will not be sent
-		_, err = c.GetBot().Send(to, text, options...)
-	} else {
-		_, err = c.GetBot().Send(to, text)
+	result := ProcessResult{Outcome: Finished}
+	if alreadyDone != nil {
+		alreadyDone(of, m)
 	}
-	if err == nil {
-		c.SetPosition(to, c.root.next)
+	if repeat != nil && repeat.text != "" {
+		_, result.Err = c.sendWith(bot, of, nil, repeat.text, repeat.options...)
 	}
-	return
+	return result
 }
 
 /*
-	Process with the next flow iteration
-	Returns true only if the iteration was successful
+	Sets a function that builds a summary of the collected data
+	The summary is sent once the user completes the flow, right before the complete callback fires.
+	An empty summary is not sent
 */
-func (c *Chain) Process(m *tb.Message) bool {
-	if m == nil {
-		return false
+func (c *Chain) SetSummaryFunc(summary func(recipient tb.Recipient, state map[string]interface{}) string) *Chain {
+	c.mx.Lock()
+	c.summary = summary
+	c.unlock()
+	return c
+}
+
+/*
+	Sends the summary, removes the user from the flow and fires the complete callback
+	It's a no-op for a user who has already left the flow, e.g. cancelled by the endpoint
+*/
+func (c *Chain) complete(bot *tb.Bot, of tb.Recipient, last *Node) {
+	if _, ok := c.GetPosition(of); !ok {
+		return
 	}
-	sender := m.Sender
-	node, ok := c.GetPosition(sender)
+	c.mx.RLock()
+	summary := c.summary
+	c.mx.RUnlock()
+	if summary != nil {
+		data, _ := c.GetAllData(of)
+		if text := summary(of, data); text != "" {
+			c.sendWith(bot, of, last, text)
+		}
+	}
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	s, ok := sh.remove(of.Recipient())
+	sh.mx.Unlock()
 	if !ok {
-		// the flow hasn't started for the user
-		return false
+		// the user has left the flow in the meantime
+		return
 	}
-	if node == nil {
-		c.DeletePosition(sender)
-		return false
+	c.totals.addCompleted(1)
+	c.mx.RLock()
+	onComplete, onCompleteData, onAudit := c.onComplete, c.onCompleteData, c.onAudit
+	c.mx.RUnlock()
+	if onComplete != nil {
+		onComplete(of, last)
 	}
-	if !node.CheckEvent(m) || node.endpoint == nil {
-		// input is invalid for the particular node
-		if c.defaultHandler != nil {
-			next := c.defaultHandler(node, m)
-			if next != node {
-				c.SetPosition(sender, next)
-			}
-			return true
+	if onCompleteData == nil && onAudit == nil {
+		return
+	}
+	data := make(map[string]interface{}, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	var history []string
+	if s.history != nil {
+		history = make([]string, len(s.history))
+		copy(history, s.history)
+	}
+	if onCompleteData != nil {
+		onCompleteData(of.Recipient(), data)
+	}
+	if onAudit != nil {
+		onAudit(of, last, data, history)
+	}
+}
+
+/*
+	Checks the chain for configuration mistakes
+*/
+func (c *Chain) Validate() error {
+	for node := c.root.next; node != nil; node = node.next {
+		if node.finish != nil && node.GetEndpoint() != nil {
+			return errors.Wrap(ErrFinishWithEndpoint, node.id)
 		}
-		return false
 	}
-	next := node.endpoint(node, m)
-	if next != node {
-		c.SetPosition(sender, next)
+	return nil
+}
+
+/*
+	Search for a node with ID
+*/
+func (c *Chain) Search(nodeId string) (*Node, bool) {
+	return c.root.SearchDown(nodeId)
+}
+
+/*
+	Replaces the endpoint of a node with ID, see Node.SetEndpoint
+*/
+func (c *Chain) SetEndpoint(nodeId string, endpoint Callback) error {
+	node, ok := c.Search(nodeId)
+	if !ok {
+		return &NodeNotFoundError{NodeId: nodeId}
 	}
-	return true
+	node.SetEndpoint(endpoint)
+	return nil
+}
+
+/*
+	Replaces the validator of a node with ID, see Node.SetValidator
+*/
+func (c *Chain) SetValidator(nodeId string, validator Validator) error {
+	node, ok := c.Search(nodeId)
+	if !ok {
+		return &NodeNotFoundError{NodeId: nodeId}
+	}
+	node.SetValidator(validator)
+	return nil
+}
+
+/*
+	Replaces the prompt of a node with ID
+	It is safe to call while the flow is processing messages
+*/
+func (c *Chain) SetPrompt(nodeId string, text string, options ...interface{}) error {
+	node, ok := c.Search(nodeId)
+	if !ok {
+		return &NodeNotFoundError{NodeId: nodeId}
+	}
+	c.mx.Lock()
+	node.prompt = &message{text: text, options: options}
+	c.unlock()
+	return nil
+}
+
+/*
+	Get the root node
+*/
+func (c *Chain) SetDefaultHandler(endpoint Callback) *Chain {
+	c.defaultHandler = endpoint
+	return c
+}
+
+/*
+	Sets send options that are merged into every message sent by the flow
+	The fields are merged rather than replaced, so a node may set only a keyboard keeping the parse mode.
+	The precedence is: options of a particular call > options of a node > flow defaults.
+	Flags like DisableNotification can only be turned on by the options that take precedence
+*/
+func (c *Chain) SetDefaultSendOptions(opts *tb.SendOptions) *Chain {
+	c.mx.Lock()
+	if opts != nil {
+		copied := *opts
+		c.defaultOptions = &copied
+	} else {
+		c.defaultOptions = nil
+	}
+	c.unlock()
+	return c
+}
+
+/*
+	Sets commands that are never processed by the flow, e.g. "/help"
+	Such messages are left for other bot handlers and the user position is kept
+*/
+func (c *Chain) SetTransparentCommands(commands ...string) *Chain {
+	transparent := make(map[string]bool, len(commands))
+	for _, command := range commands {
+		transparent[command] = true
+	}
+	c.mx.Lock()
+	c.transparent = transparent
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a predicate for messages that are left for other handlers like transparent commands,
+	Process returns false for them without firing the default handler or touching the state
+	It runs after the user position is looked up but before the input is validated
+*/
+func (c *Chain) SetPassthrough(passthrough func(m *tb.Message) bool) *Chain {
+	c.mx.Lock()
+	c.passthrough = passthrough
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a message that is sent to a paused user instead of processing the input, see PauseFor
+*/
+func (c *Chain) SetPauseMessage(text string) *Chain {
+	return c.SetPauseMessageFunc(func(recipient tb.Recipient, until time.Time) string {
+		return text
+	})
+}
+
+/*
+	Sets a function that builds the pause message dynamically, e.g. to tell when the pause is over
+	An empty text means no message is sent
+*/
+func (c *Chain) SetPauseMessageFunc(textFunc func(recipient tb.Recipient, until time.Time) string) *Chain {
+	c.mx.Lock()
+	c.pauseMessage = textFunc
+	c.unlock()
+	return c
+}
+
+/*
+	Checks if the user is paused and builds the pause message for the user
+*/
+func (c *Chain) pauseOf(of tb.Recipient) (bool, string) {
+	until, paused := c.pausedUntil(of)
+	if !paused {
+		return false, ""
+	}
+	pauseMessage := c.settings().pauseMessage
+	if pauseMessage == nil {
+		return true, ""
+	}
+	return true, pauseMessage(of, until)
+}
+
+/*
+	Sets the messages that ask for help on the current step, e.g. "?" or "/help"
+	The user gets the help text of the node and stays on it, see Node.SetHelp
+*/
+func (c *Chain) SetHelpTrigger(triggers ...string) *Chain {
+	helpTriggers := make(map[string]bool, len(triggers))
+	for _, trigger := range triggers {
+		helpTriggers[trigger] = true
+	}
+	c.mx.Lock()
+	c.helpTriggers = helpTriggers
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a help text for the nodes that have no help text of their own
+*/
+func (c *Chain) SetDefaultHelp(text string) *Chain {
+	c.mx.Lock()
+	c.defaultHelp = text
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the help text if the message asks for help, otherwise an empty string
+	Messages asking for help on a node without any help text are processed as usual
+*/
+func (cfg *settings) helpFor(node *Node, m *tb.Message) string {
+	text := strings.TrimSpace(m.Text)
+	if len(cfg.helpTriggers) == 0 || text == "" {
+		return ""
+	}
+	if command := commandOf(m); !cfg.helpTriggers[text] && (command == "" || !cfg.helpTriggers[command]) {
+		return ""
+	}
+	if node.help != "" {
+		return node.help
+	}
+	return cfg.defaultHelp
+}
+
+/*
+	Checks if the message is a transparent command
+*/
+func (cfg *settings) isTransparent(m *tb.Message) bool {
+	command := commandOf(m)
+	if command == "" {
+		return false
+	}
+	return cfg.transparent[command]
+}
+
+/*
+	Gets the command the message starts with or an empty string
+*/
+func commandOf(m *tb.Message) string {
+	if !strings.HasPrefix(m.Text, "/") {
+		return ""
+	}
+	command := strings.Fields(m.Text)[0]
+	// commands in groups may be addressed as /command@bot
+	if i := strings.Index(command, "@"); i > 0 {
+		command = command[:i]
+	}
+	return command
+}
+
+/*
+	Sets a command that starts the flow, e.g. "/signup", see Router.HandleTriggers
+*/
+func (c *Chain) SetTrigger(command string) *Chain {
+	c.mx.Lock()
+	c.trigger = command
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the command that starts the flow
+*/
+func (c *Chain) GetTrigger() string {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.trigger
+}
+
+/*
+	Checks if the message is the command that starts the flow
+*/
+func (c *Chain) isTrigger(m *tb.Message) bool {
+	trigger := c.GetTrigger()
+	return trigger != "" && commandOf(m) == trigger
+}
+
+/*
+	Starts the flow for a user that has sent the trigger command
+	The prompt of the first stage is sent if it's set, otherwise the intro, see SetIntro
+*/
+func (c *Chain) startTriggered(to tb.Recipient) error {
+	if first := c.root.next; first != nil && first.HasPrompt() {
+		return c.StartAuto(to)
+	}
+	return c.Start(to, "")
+}
+
+/*
+	Restricts the flow to the chats of specified types, e.g. tb.ChatPrivate
+	Messages and callbacks from other chats are not processed and leave the state untouched.
+	All the chat types are allowed by default, calling it without types removes the restriction
+*/
+func (c *Chain) SetChatTypes(types ...tb.ChatType) *Chain {
+	var chatTypes map[tb.ChatType]bool
+	if len(types) > 0 {
+		chatTypes = make(map[tb.ChatType]bool, len(types))
+		for _, chatType := range types {
+			chatTypes[chatType] = true
+		}
+	}
+	c.mx.Lock()
+	c.chatTypes = chatTypes
+	c.unlock()
+	return c
+}
+
+/*
+	Checks if the flow runs in the chat
+*/
+func (cfg *settings) allowsChat(chat *tb.Chat) bool {
+	if cfg.chatTypes == nil || chat == nil {
+		return true
+	}
+	return cfg.chatTypes[chat.Type]
+}
+
+/*
+	Sets a function that post-processes every text the flow sends, e.g. to append a footer
+	The node may be nil for messages that don't belong to a node like the initial one
+*/
+func (c *Chain) SetTextTransformer(transformer func(recipient tb.Recipient, node *Node, text string) string) *Chain {
+	c.mx.Lock()
+	c.transformer = transformer
+	c.unlock()
+	return c
+}
+
+/*
+	Applies the text transformer
+*/
+func (c *Chain) transform(to tb.Recipient, node *Node, text string) string {
+	transformer := c.settings().transformer
+	if transformer == nil {
+		return text
+	}
+	return transformer(to, node, text)
+}
+
+/*
+	Sets a filter for messages that are considered flow input at all, e.g. to skip service messages
+	Messages failing the filter are not processed and leave the state untouched, all messages pass by default
+*/
+func (c *Chain) SetUpdateFilter(filter func(m *tb.Message) bool) *Chain {
+	c.mx.Lock()
+	c.updateFilter = filter
+	c.unlock()
+	return c
+}
+
+/*
+	Checks if the message passes the update filter
+*/
+func (cfg *settings) accepts(m *tb.Message) bool {
+	return cfg.updateFilter == nil || cfg.updateFilter(m)
+}
+
+/*
+	Sends a message on behalf of the flow applying the default send options
+*/
+func (c *Chain) send(to tb.Recipient, node *Node, what interface{}, options ...interface{}) (*tb.Message, error) {
+	return c.sendWith(c.GetBot(), to, node, what, options...)
+}
+
+/*
+	Sends a message on behalf of the flow with a specified bot
+	The node is the one the message is sent for and may be nil
+*/
+func (c *Chain) sendWith(bot *tb.Bot, to tb.Recipient, node *Node, what interface{}, options ...interface{}) (*tb.Message, error) {
+	defaults := c.settings().defaultOptions
+	if text, ok := what.(string); ok {
+		what = c.transform(to, node, text)
+	}
+	options = mergeSendOptions(defaults, options)
+	if c.intercept(OutgoingMessage{Action: ActionSend, Recipient: to.Recipient(), Node: node, What: what, Options: options}) {
+		return &tb.Message{}, nil
+	}
+	if len(options) > 0 {
+		return bot.Send(to, what, options...)
+	}
+	// a workaround for nil options
+	// otherwise the message will not be sent
+	return bot.Send(to, what)
+}
+
+/*
+	Sends the prompt of a node to the user
+*/
+func (c *Chain) sendPrompt(to tb.Recipient, node *Node, extra ...interface{}) error {
+	return c.sendPromptWith(c.GetBot(), to, node, extra...)
+}
+
+/*
+	Sends the prompt of a node to the user with a specified bot and remembers it as the last prompt
+*/
+func (c *Chain) sendPromptWith(bot *tb.Bot, to tb.Recipient, node *Node, extra ...interface{}) error {
+	msg, err := c.deliverPrompt(bot, to, node, extra...)
+	if err != nil {
+		return err
+	}
+	c.setPromptMessage(to, msg)
+	return nil
+}
+
+/*
+	Sends the prompt of a node to the user with a specified bot, the message is nil if nothing was sent
+	An empty prompt text means there's nothing to send, the node waits for the input silently,
+	a media prompt is sent without a caption then
+*/
+func (c *Chain) deliverPrompt(bot *tb.Bot, to tb.Recipient, node *Node, extra ...interface{}) (*tb.Message, error) {
+	if !node.HasPrompt() {
+		return nil, ErrNoPrompt
+	}
+	text := node.GetPromptText(to)
+	if text == "" && node.media == nil {
+		return nil, nil
+	}
+	var options []interface{}
+	if prompt := node.getPrompt(); prompt != nil {
+		options = append(options, prompt.options...)
+	}
+	// options of a particular call go last to take precedence over the node ones
+	options = append(options, extra...)
+	// senders use the bot on their own, so they are skipped when the calls are not to be made
+	cfg := c.settings()
+	intercepted := cfg.outgoing != nil || cfg.dryRun
+	if node.sender != nil && !intercepted {
+		defaults := cfg.defaultOptions
+		last, _ := c.getPromptMessage(to)
+		return node.sender(SendContext{
+			Bot:       bot,
+			Recipient: to,
+			Node:      node,
+			Text:      c.transform(to, node, text),
+			Media:     node.media,
+			Options:   mergeSendOptions(defaults, options),
+			Last:      last,
+		})
+	}
+	if node.media != nil {
+		return c.sendWith(bot, to, node, withCaption(node.media, c.transform(to, node, text)), options...)
+	}
+	return c.sendWith(bot, to, node, text, options...)
+}
+
+/*
+	Sends the prompt of the current node to the user once again without advancing
+	The options take precedence over the prompt options of the node
+*/
+func (c *Chain) Reprompt(of tb.Recipient, options ...interface{}) error {
+	node, ok := c.GetPosition(of)
+	if !ok || node == nil {
+		return ErrUserNotInFlow
+	}
+	return c.sendPrompt(of, node, options...)
+}
+
+/*
+	Renders the dynamic prompt of the current node again, e.g. after an endpoint has updated the data
+	The previous prompt is edited in place when possible, otherwise a new one is sent.
+	The user doesn't advance and the attempts are kept
+*/
+func (c *Chain) RefreshPrompt(of tb.Recipient) error {
+	node, ok := c.GetPosition(of)
+	if !ok || node == nil {
+		return ErrUserNotInFlow
+	}
+	if node.textFunc == nil {
+		return ErrNoDynamicPrompt
+	}
+	msg, err := c.getPromptMessage(of)
+	if err != nil || node.sender != nil || node.media != nil {
+		// there is nothing to edit, the sender decides on its own how to update the prompt
+		// or the prompt is a media that can't be edited as a text
+		return c.sendPrompt(of, node)
+	}
+	var options []interface{}
+	if prompt := node.getPrompt(); prompt != nil {
+		options = prompt.options
+	}
+	c.mx.RLock()
+	defaults := c.defaultOptions
+	c.mx.RUnlock()
+	text := node.GetPromptText(of)
+	if text == "" {
+		// nothing to show, the previous prompt is kept as it is
+		return nil
+	}
+	text, options = c.transform(of, node, text), mergeSendOptions(defaults, options)
+	if c.intercept(OutgoingMessage{Action: ActionEdit, Recipient: of.Recipient(), Node: node, What: text, Options: options}) {
+		return nil
+	}
+	edited, err := c.GetBot().Edit(msg, text, options...)
+	if err != nil {
+		if strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		return err
+	}
+	c.setPromptMessage(of, edited)
+	return nil
+}
+
+/*
+	Replaces the inline keyboard of the last prompt sent to the user keeping the text
+	An attempt to set the same markup again is not considered an error
+*/
+func (c *Chain) EditMarkup(of tb.Recipient, markup *tb.ReplyMarkup) error {
+	msg, err := c.getPromptMessage(of)
+	if err != nil {
+		return err
+	}
+	if c.intercept(OutgoingMessage{Action: ActionMarkup, Recipient: of.Recipient(), What: markup}) {
+		return nil
+	}
+	edited, err := c.GetBot().EditReplyMarkup(msg, markup)
+	if err != nil {
+		if strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		return err
+	}
+	c.setPromptMessage(of, edited)
+	return nil
+}
+
+/*
+	Merges the default send options with the options of a particular call
+	Non-zero fields of explicitly provided send options override the defaults, later options override earlier ones.
+	Markups, parse modes and flags provided separately are merged in the same order,
+	so a bare option of a node doesn't override the send options of the call that follows it
+*/
+func mergeSendOptions(defaults *tb.SendOptions, options []interface{}) []interface{} {
+	if defaults == nil {
+		defaults = &tb.SendOptions{}
+	}
+	merged := *defaults
+	rest := make([]interface{}, 0, len(options))
+	for _, option := range options {
+		var opts *tb.SendOptions
+		switch option := option.(type) {
+		case *tb.SendOptions:
+			opts = option
+		case *tb.ReplyMarkup:
+			opts = &tb.SendOptions{ReplyMarkup: option}
+		case tb.ParseMode:
+			opts = &tb.SendOptions{ParseMode: option}
+		case tb.Option:
+			switch option {
+			case tb.NoPreview:
+				merged.DisableWebPagePreview = true
+			case tb.Silent:
+				merged.DisableNotification = true
+			case tb.ForceReply, tb.OneTimeKeyboard:
+				// the markup is copied, it may be shared by the node or the defaults
+				markup := &tb.ReplyMarkup{}
+				if merged.ReplyMarkup != nil {
+					copied := *merged.ReplyMarkup
+					markup = &copied
+				}
+				markup.ForceReply = markup.ForceReply || option == tb.ForceReply
+				markup.OneTimeKeyboard = markup.OneTimeKeyboard || option == tb.OneTimeKeyboard
+				merged.ReplyMarkup = markup
+			default:
+				rest = append(rest, option)
+			}
+			continue
+		default:
+			rest = append(rest, option)
+			continue
+		}
+		if opts == nil {
+			continue
+		}
+		if opts.ReplyTo != nil {
+			merged.ReplyTo = opts.ReplyTo
+		}
+		if opts.ReplyMarkup != nil {
+			merged.ReplyMarkup = opts.ReplyMarkup
+		}
+		if opts.DisableWebPagePreview {
+			merged.DisableWebPagePreview = true
+		}
+		if opts.DisableNotification {
+			merged.DisableNotification = true
+		}
+		if opts.ParseMode != tb.ModeDefault {
+			merged.ParseMode = opts.ParseMode
+		}
+	}
+	// other options are passed to telebot as they are
+	return append([]interface{}{&merged}, rest...)
+}
+
+/*
+	Executes the chain for the user by putting him on a first stage of the chain
+	Data collected by the user in a previous run is cleared
+	An empty text makes the flow send the intro, see SetIntro
+*/
+func (c *Chain) Start(to tb.Recipient, text string, options ...interface{}) (err error) {
+	if c.root.next == nil {
+		return ErrChainIsEmpty
+	}
+	text, options = c.introOr(text, options)
+	return c.startAt(to, to, c.root.next, false, nil, text, options...)
+}
+
+/*
+	Executes the chain like Start does but sends the initial message to one recipient
+	and tracks the position under a separate identifier, e.g. for flows started by an admin on behalf of a user
+	The messages the flow sends later go to the tracked identifier
+*/
+func (c *Chain) StartFor(sendTo tb.Recipient, trackAs string, text string, options ...interface{}) error {
+	if c.root.next == nil {
+		return ErrChainIsEmpty
+	}
+	text, options = c.introOr(text, options)
+	return c.startAt(sendTo, recipientId(trackAs), c.root.next, false, nil, text, options...)
+}
+
+/*
+	Executes the chain for the user like Start does sending the prompt of the first stage as the initial message
+	The options take precedence over the prompt options. Returns ErrNoPrompt if the first stage has no prompt,
+	set one with Node.SetPrompt or use Start instead
+*/
+func (c *Chain) StartAuto(to tb.Recipient, options ...interface{}) (err error) {
+	first := c.root.next
+	if first == nil {
+		return ErrChainIsEmpty
+	}
+	if !first.HasPrompt() {
+		return errors.Wrap(ErrNoPrompt, first.id)
+	}
+	if c.isClosed() {
+		return ErrFlowClosed
+	}
+	// the callback fires once the messages of the user are let through
+	defer func() {
+		if err == nil {
+			c.started(to, first)
+		}
+	}()
+	if err := c.checkRestart(to); err != nil {
+		return err
+	}
+	// the hold goes after the restart check, so OnRestart may start the user over
+	defer c.beginStart(to)()
+	// the prompt goes first, so a failed send leaves the previous state of the user untouched
+	msg, err := c.deliverPrompt(c.GetBot(), to, first, options...)
+	if err != nil {
+		return err
+	}
+	c.resetPosition(to, first)
+	c.setPromptMessage(to, msg)
+	return nil
+}
+
+/*
+	Executes the chain for the user like Start does seeding the user data with the initial values,
+	e.g. with the answers that are known from a profile. The data is cleared on completion as usual
+*/
+func (c *Chain) StartWithState(to tb.Recipient, text string, initial map[string]interface{}, options ...interface{}) error {
+	if c.root.next == nil {
+		return ErrChainIsEmpty
+	}
+	text, options = c.introOr(text, options)
+	return c.startAt(to, to, c.root.next, false, initial, text, options...)
+}
+
+/*
+	Executes the chain for the user like Start does but preserves the data collected before
+*/
+func (c *Chain) StartKeepingState(to tb.Recipient, text string, options ...interface{}) error {
+	if c.root.next == nil {
+		return ErrChainIsEmpty
+	}
+	text, options = c.introOr(text, options)
+	return c.startAt(to, to, c.root.next, true, nil, text, options...)
+}
+
+/*
+	Sets an initial message that is sent by Start when no text is given
+*/
+func (c *Chain) SetIntro(text string, options ...interface{}) *Chain {
+	c.mx.Lock()
+	c.intro = &message{text: text, options: options}
+	c.unlock()
+	return c
+}
+
+/*
+	Picks the intro unless an explicit text is given
+*/
+func (c *Chain) introOr(text string, options []interface{}) (string, []interface{}) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if text != "" || c.intro == nil {
+		return text, options
+	}
+	if len(options) == 0 {
+		options = c.intro.options
+	}
+	return c.intro.text, options
+}
+
+/*
+	Executes the chain for the user starting at a node with ID
+	The text is sent as the initial message instead of the one expected by the previous stage
+*/
+func (c *Chain) StartFrom(to tb.Recipient, nodeId string, text string, options ...interface{}) error {
+	node, ok := c.Search(nodeId)
+	if !ok {
+		return &NodeNotFoundError{NodeId: nodeId}
+	}
+	return c.startAt(to, to, node, false, nil, text, options...)
+}
+
+/*
+	Sets what happens when the flow is started for a user that is already in it
+	The default policy is Overwrite
+*/
+func (c *Chain) SetRestartPolicy(policy RestartPolicy) *Chain {
+	c.mx.Lock()
+	c.restartPolicy = policy
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers with the Confirm policy when an active user is started again
+	The callback may cancel the user and start the flow over, or keep the progress
+*/
+func (c *Chain) OnRestart(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onRestart = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Puts the user on a first stage of the chain silently without sending any message
+	The next processed message drives the flow as usual
+*/
+func (c *Chain) Enter(of tb.Recipient) error {
+	if c.root.next == nil {
+		return ErrChainIsEmpty
+	}
+	if c.isClosed() {
+		return ErrFlowClosed
+	}
+	if err := c.checkRestart(of); err != nil {
+		return err
+	}
+	c.resetPosition(of, c.root.next)
+	c.started(of, c.root.next)
+	return nil
+}
+
+/*
+	Applies the restart policy if the user is already in the flow
+*/
+func (c *Chain) checkRestart(to tb.Recipient) error {
+	current, ok := c.GetPosition(to)
+	if !ok || current == nil {
+		return nil
+	}
+	c.mx.RLock()
+	policy, onRestart := c.restartPolicy, c.onRestart
+	c.mx.RUnlock()
+	switch policy {
+	case Ignore:
+		return ErrAlreadyStarted
+	case Confirm:
+		if onRestart != nil {
+			onRestart(to, current)
+		}
+		return ErrAlreadyStarted
+	}
+	return nil
+}
+
+/*
+	Sends the initial message to one recipient and puts a user tracked by another one on a specified node
+	Any previous state of the user is discarded unless it's asked to be kept
+*/
+func (c *Chain) startAt(sendTo, trackAs tb.Recipient, node *Node, keepState bool, initial map[string]interface{}, text string, options ...interface{}) (err error) {
+	if c.isClosed() {
+		return ErrFlowClosed
+	}
+	// the callback fires once the messages of the user are let through
+	defer func() {
+		if err == nil {
+			c.started(trackAs, node)
+		}
+	}()
+	if err := c.checkRestart(trackAs); err != nil {
+		return err
+	}
+	// the messages of the user wait until the position is set, otherwise they could be taken as not in the flow.
+	// The hold goes after the restart check, so OnRestart may start the user over
+	defer c.beginStart(trackAs)()
+	msg, err := c.send(sendTo, nil, text, options...)
+	if err != nil {
+		return err
+	}
+	if keepState {
+		c.SetPosition(trackAs, node)
+	} else {
+		c.resetPosition(trackAs, node)
+	}
+	for key, value := range initial {
+		c.SetData(trackAs, key, value)
+	}
+	c.setPromptMessage(trackAs, msg)
+	return nil
+}
+
+/*
+	Outcome describes what happened to a message passed to the flow
+*/
+type Outcome int
+
+const (
+	NotActive Outcome = iota // the user is not in the flow
+	Passed                   // the message is a transparent command and was left for other handlers
+	Rejected                 // the input is invalid and there's no default handler
+	Defaulted                // the input is invalid and was handled by the default handler
+	Stayed                   // the input was handled and the user stays on the same node
+	Advanced                 // the input was handled and the user moved to another node
+	Completed                // the input was handled and the user has finished the flow
+	Dropped                  // the message arrived while a previous one was in flight and was dropped
+	Queued                   // the message arrived while a previous one was in flight and will be processed after it
+	Paused                   // the user is paused and the message was ignored
+	Finished                 // the user has completed the flow already, see Chain.SetRepeatCompleteMessage
+)
+
+/*
+	A result of processing a message
+	From is the node that processed the message, To is the node the user ended up on
+*/
+type ProcessResult struct {
+	Outcome Outcome
+	From    *Node
+	To      *Node
+	Err     error
+}
+
+/*
+	Checks if the flow has handled the message
+	It depends on the outcome only, a message is handled even if a later send failed, e.g. the prompt
+	of the next node, since the user has moved on already. The error is reported by Err
+*/
+func (r ProcessResult) Handled() bool {
+	switch r.Outcome {
+	case Defaulted, Stayed, Advanced, Completed, Finished:
+		return true
+	}
+	return false
+}
+
+/*
+	Checks if the message belongs to the flow, i.e. the user is in the flow and the message is not transparent
+	Unlike Handled it's true for rejected input as well, so other handlers should not take such a message
+*/
+func (r ProcessResult) Claimed() bool {
+	return r.Outcome != NotActive && r.Outcome != Passed
+}
+
+/*
+	Process with the next flow iteration
+	Returns true if the flow has handled the message, see ProcessResult.Handled.
+	Errors of the sends that follow are reported by ProcessDetailed only
+*/
+func (c *Chain) Process(m *tb.Message) bool {
+	return c.process(c.GetBot(), m).Handled()
+}
+
+/*
+	Process with the next flow iteration for an update received by a specified bot
+	Messages sent by the flow itself go through that bot, which allows several bots to share one flow.
+	Positions are shared between the bots, so a user may continue with any of them.
+	Endpoints still have to pick a bot on their own, GetBot returns the bot the flow was created with
+*/
+func (c *Chain) ProcessWith(bot *tb.Bot, m *tb.Message) bool {
+	return c.process(bot, m).Handled()
+}
+
+/*
+	Process with the next flow iteration and tell exactly what has happened
+*/
+func (c *Chain) ProcessDetailed(m *tb.Message) ProcessResult {
+	return c.process(c.GetBot(), m)
+}
+
+/*
+	Process with the next flow iteration applying the in-flight policy
+*/
+func (c *Chain) process(bot *tb.Bot, m *tb.Message) ProcessResult {
+	// the settings are loaded once, so the message doesn't go back to the flow lock
+	cfg := c.settings()
+	if m == nil || cfg.closed {
+		return c.handle(bot, m)
+	}
+	if !cfg.allowsChat(m.Chat) || !cfg.accepts(m) {
+		// messages that are not for the flow neither wait for a start nor get dropped or queued
+		return ProcessResult{Outcome: NotActive}
+	}
+	key := cfg.keyOf(m)
+	if m.Sender != nil {
+		c.awaitStart(key)
+	}
+	if cfg.inFlight == InFlightAllow {
+		return c.handleAccepted(cfg, bot, m)
+	}
+	outcome, owner, ok := c.acquire(key, m, cfg.inFlight)
+	if !ok {
+		return ProcessResult{Outcome: outcome}
+	}
+	result := c.handleAccepted(cfg, bot, m)
+	if owner == nil {
+		// another call may have marked the user in the meantime, it's up to that call to release the user
+		return result
+	}
+	for next := c.release(key, owner); next != nil; next = c.release(key, owner) {
+		c.handleAccepted(cfg, bot, next)
+	}
+	return result
+}
+
+/*
+	Process with the next flow iteration
+*/
+func (c *Chain) handle(bot *tb.Bot, m *tb.Message) ProcessResult {
+	cfg := c.settings()
+	if cfg.closed {
+		return ProcessResult{Outcome: NotActive, Err: ErrFlowClosed}
+	}
+	if m == nil || !cfg.allowsChat(m.Chat) || !cfg.accepts(m) {
+		return ProcessResult{Outcome: NotActive}
+	}
+	return c.handleAccepted(cfg, bot, m)
+}
+
+/*
+	Process with the next flow iteration a message that has passed the chat types and the update filter
+*/
+func (c *Chain) handleAccepted(cfg *settings, bot *tb.Bot, m *tb.Message) ProcessResult {
+	if cfg.closed {
+		return ProcessResult{Outcome: NotActive, Err: ErrFlowClosed}
+	}
+	sender := cfg.keyOf(m)
+	node, ok := c.GetPosition(sender)
+	if !ok {
+		// the flow hasn't started for the user
+		return ProcessResult{Outcome: NotActive}
+	}
+	if node == nil {
+		return c.repeatCompleted(bot, sender, m)
+	}
+	if !c.contains(node) {
+		return c.recover(sender)
+	}
+	if cfg.isTransparent(m) || (cfg.passthrough != nil && cfg.passthrough(m)) {
+		return ProcessResult{Outcome: Passed, From: node, To: node}
+	}
+	if help := cfg.helpFor(node, m); help != "" {
+		result := ProcessResult{Outcome: Stayed, From: node, To: node}
+		_, result.Err = c.sendWith(bot, sender, node, help)
+		return result
+	}
+	if paused, text := c.pauseOf(sender); paused {
+		result := ProcessResult{Outcome: Paused, From: node, To: node}
+		if text != "" {
+			_, result.Err = c.sendWith(bot, sender, node, text)
+		}
+		return result
+	}
+	c.touch(sender)
+	if allowed, reason := c.admits(sender, m); !allowed {
+		result := ProcessResult{Outcome: Rejected, From: node, To: node}
+		if reason != "" {
+			_, result.Err = c.sendWith(bot, sender, node, reason)
+		}
+		return result
+	}
+	if node.minDelay > 0 && time.Since(c.arrivedAt(sender)) < node.minDelay {
+		// the answer is too fast to be real, so it's not stored either
+		c.stay(sender, node)
+		return c.reject(bot, sender, node)
+	}
+	// the answer is stored only once the input is accepted
+	var answer interface{}
+	var answered bool
+	if node.dateLayouts != nil && node.CheckEvent(m) {
+		date, ok := node.parseDate(m.Text, c.UserTimezone(sender))
+		if !ok {
+			c.stay(sender, node)
+			return c.reject(bot, sender, node)
+		}
+		answer, answered = date, true
+	} else if node.CheckEvent(m) {
+		answer, answered = node.answerOf(m)
+	}
+	if node.collect != nil {
+		// collected inputs are not validated
+		if answered {
+			c.SetData(sender, node.id, answer)
+		}
+		if node.collect.until(m) {
+			// the collection is over
+			if endpoint := node.GetEndpoint(); endpoint != nil {
+				return c.transit(cfg, bot, sender, m, node, c.call(endpoint, node, m))
+			}
+			return c.transit(cfg, bot, sender, m, node, node.route(m, sender))
+		}
+		if node.CheckEvent(m) {
+			c.appendCollected(sender, node.collect.key, m)
+			return ProcessResult{Outcome: Stayed, From: node, To: node}
+		}
+	}
+	if node.CheckEvent(m) {
+		if err := c.validate(sender, node, m); err != nil {
+			c.stay(sender, node)
+			if _, sendErr := c.sendWith(bot, sender, node, err.Error()); sendErr != nil {
+				return ProcessResult{Outcome: Rejected, From: node, To: node, Err: sendErr}
+			}
+			return ProcessResult{Outcome: Rejected, From: node, To: node}
+		}
+	}
+	if answered {
+		c.SetData(sender, node.id, answer)
+	}
+	if node.finish != nil && node.CheckEvent(m) {
+		if _, err := c.sendWith(bot, sender, node, node.finish.text, node.finish.options...); err != nil {
+			return ProcessResult{Outcome: Stayed, From: node, To: node, Err: err}
+		}
+		c.complete(bot, sender, node)
+		return ProcessResult{Outcome: Completed, From: node}
+	}
+	endpoint := node.GetEndpoint()
+	if node.CheckEvent(m) && endpoint == nil && node.hasRoutes() {
+		// the node is routed declaratively
+		return c.transit(cfg, bot, sender, m, node, node.ResolveNext(m, sender))
+	}
+	if !node.CheckEvent(m) || endpoint == nil {
+		// input is invalid for the particular node
+		if c.defaultHandler != nil {
+			result := c.transit(cfg, bot, sender, m, node, c.defaultHandler(node, m))
+			result.Outcome = Defaulted
+			return result
+		}
+		c.stay(sender, node)
+		return c.reject(bot, sender, node)
+	}
+	return c.transit(cfg, bot, sender, m, node, c.call(endpoint, node, m))
+}
+
+/*
+	Calls the endpoint of a node measuring how long it takes
+*/
+func (c *Chain) call(endpoint Callback, node *Node, m *tb.Message) *Node {
+	onDuration := c.settings().onDuration
+	if onDuration == nil {
+		return endpoint(node, m)
+	}
+	started := time.Now()
+	next := endpoint(node, m)
+	onDuration(c.id, node.id, time.Since(started))
+	return next
+}
+
+/*
+	Sets a callback that receives the wall-clock duration of every endpoint call, e.g. to find slow steps
+*/
+func (c *Chain) OnEndpointDuration(callback func(flowId, nodeId string, d time.Duration)) *Chain {
+	c.mx.Lock()
+	c.onDuration = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Runs the validators of a node against the input
+*/
+func (c *Chain) validate(of tb.Recipient, node *Node, m *tb.Message) error {
+	ns := c.nodeSettings(node)
+	validator, dataValidator, validators := ns.validator, ns.dataValidator, ns.validators
+	if validator != nil {
+		if err := validator(m); err != nil {
+			return err
+		}
+	}
+	if dataValidator == nil && len(validators) == 0 {
+		return nil
+	}
+	data, _ := c.GetAllData(of)
+	if dataValidator != nil {
+		if err := dataValidator(m, data); err != nil {
+			return err
+		}
+	}
+	for _, validator := range validators {
+		if err := validator.check(m, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Checks if the node would accept the input of the user without storing anything, see Node.ResolveNext
+	The recipient may be nil, the checks that depend on the user state are skipped then
+*/
+func (c *Chain) acceptable(of tb.Recipient, node *Node, m *tb.Message) bool {
+	if of != nil && node.minDelay > 0 && time.Since(c.arrivedAt(of)) < node.minDelay {
+		return false
+	}
+	if node.dateLayouts != nil {
+		loc := time.UTC
+		if of != nil {
+			loc = c.UserTimezone(of)
+		}
+		if _, ok := node.parseDate(m.Text, loc); !ok {
+			return false
+		}
+	}
+	if node.collect != nil {
+		// collected inputs are not validated
+		return true
+	}
+	if of == nil {
+		// an unknown recipient has no data
+		of = recipientId("")
+	}
+	return c.validate(of, node, m) == nil
+}
+
+/*
+	Tells the user the input is invalid, the retry message of the node takes precedence
+	over the invalid input message of the flow
+*/
+func (c *Chain) reject(bot *tb.Bot, of tb.Recipient, node *Node) ProcessResult {
+	result := ProcessResult{Outcome: Rejected, From: node, To: node}
+	if node.retry != nil {
+		_, result.Err = c.sendWith(bot, of, node, node.retry.text, node.retry.options...)
+		return result
+	}
+	invalidInput := c.settings().invalidInput
+	if invalidInput != nil {
+		if text := invalidInput(node, of); text != "" {
+			_, result.Err = c.sendWith(bot, of, node, text)
+		}
+	}
+	return result
+}
+
+/*
+	Sets a message that is sent when the input is invalid for the node and there's no default handler
+	The default handler wins when both are set, the retry message of a node wins as well, see Node.SetRetryMessage
+*/
+func (c *Chain) SetInvalidInputMessage(text string) *Chain {
+	return c.SetInvalidInputMessageFunc(func(e *Node, to tb.Recipient) string {
+		return text
+	})
+}
+
+/*
+	Sets a function that builds the invalid input message dynamically, see SetInvalidInputMessage
+	An empty text means no message is sent
+*/
+func (c *Chain) SetInvalidInputMessageFunc(textFunc TextFunc) *Chain {
+	c.mx.Lock()
+	c.invalidInput = textFunc
+	c.unlock()
+	return c
+}
+
+/*
+	Processes an inline query of a user on a node that expects one, see Node.ExpectInlineQuery
+	Returns false if the user is not in the flow or the node doesn't expect an inline query
+*/
+func (c *Chain) ProcessInlineQuery(q *tb.Query) bool {
+	if q == nil || c.isClosed() {
+		return false
+	}
+	sender := &q.From
+	node, ok := c.GetPosition(sender)
+	if !ok || node == nil || !c.contains(node) || node.onQuery == nil {
+		return false
+	}
+	if paused, text := c.pauseOf(sender); paused {
+		if text != "" {
+			c.send(sender, node, text)
+		}
+		return false
+	}
+	c.touch(sender)
+	if allowed, reason := c.admits(sender, &tb.Message{Sender: &q.From}); !allowed {
+		if reason != "" {
+			c.send(sender, node, reason)
+		}
+		return false
+	}
+	c.transit(c.settings(), c.GetBot(), sender, nil, node, node.onQuery(node, q))
+	return true
+}
+
+/*
+	Checks if the node is a part of the chain
+*/
+func (c *Chain) contains(node *Node) bool {
+	if node == nil || node.flow != c {
+		return false
+	}
+	for n := c.root.next; n != nil; n = n.next {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Sets a gate that every message has to pass before any endpoint, validator or branch runs
+	A denied message is answered with the reason unless it's empty, the user stays on the node
+	and the attempt is not counted. The gate runs after the chat types and transparent commands are checked.
+	Callbacks and inline queries have to pass it as well, the gate gets a message with only their sender
+	and chat then. A denied callback is answered with the reason as a notification
+*/
+func (c *Chain) SetPrecondition(precondition func(recipient tb.Recipient, m *tb.Message) (bool, string)) *Chain {
+	c.mx.Lock()
+	c.precondition = precondition
+	c.unlock()
+	return c
+}
+
+/*
+	Runs the gate of the flow, returns the reason of a denial
+*/
+func (c *Chain) admits(of tb.Recipient, m *tb.Message) (bool, string) {
+	precondition := c.settings().precondition
+	if precondition == nil {
+		return true, ""
+	}
+	return precondition(of, m)
+}
+
+/*
+	Sets a handler that decides where to put a user whose position points at a node
+	that is not a part of the chain anymore, e.g. a node of another flow
+	It fires from Process before the message is handled, the message itself is dropped.
+	Returning nil removes the user from the flow, which is also the default behavior
+*/
+func (c *Chain) SetOnMissingNode(handler func(recipient tb.Recipient) *Node) *Chain {
+	c.mx.Lock()
+	c.onMissingNode = handler
+	c.unlock()
+	return c
+}
+
+/*
+	Handles a user whose position points at a missing node
+*/
+func (c *Chain) recover(of tb.Recipient) ProcessResult {
+	handler := c.settings().onMissingNode
+	var node *Node
+	if handler != nil {
+		node = handler(of)
+	}
+	if node == nil {
+		c.DeletePosition(of)
+		return ProcessResult{Outcome: NotActive}
+	}
+	c.SetPosition(of, node)
+	return ProcessResult{Outcome: Stayed, To: node}
+}
+
+/*
+	Moves the user from a node to the next one, the user stays if the nodes are the same
+*/
+func (c *Chain) transit(cfg *settings, bot *tb.Bot, of tb.Recipient, m *tb.Message, node, next *Node) ProcessResult {
+	next, looped := c.skip(next, m, of)
+	if looped && cfg.onLoopDetected != nil {
+		cfg.onLoopDetected(of, next)
+	}
+	if next == node {
+		c.stay(of, node)
+		return ProcessResult{Outcome: Stayed, From: node, To: node}
+	}
+	if next == nil || next.end {
+		// the flow is over
+		c.complete(bot, of, node)
+		return ProcessResult{Outcome: Completed, From: node}
+	}
+	if next.terminal {
+		c.SetPosition(of, next)
+		result := ProcessResult{Outcome: Completed, From: node, To: next}
+		if next.HasPrompt() {
+			result.Err = c.sendPromptWith(bot, of, next)
+		}
+		c.complete(bot, of, next)
+		return result
+	}
+	c.SetPosition(of, next)
+	if cfg.onAdvance != nil {
+		cfg.onAdvance(node, next, m)
+	}
+	if cfg.deletePrevious && next.sender == nil {
+		c.deletePromptMessage(bot, of)
+	}
+	if cfg.autoPrompt && next.HasPrompt() {
+		if err := c.sendPromptWith(bot, of, next); err != nil {
+			return ProcessResult{Outcome: Advanced, From: node, To: next, Err: err}
+		}
+	}
+	return ProcessResult{Outcome: Advanced, From: node, To: next}
+}
+
+/*
+	Sets a callback that triggers only when a message moves the user to another node
+	Unlike the other callbacks it does not fire when the user stays on the same node,
+	when a branch leads back to the current node or when the flow is over
+*/
+func (c *Chain) OnAdvance(callback AdvanceCallback) *Chain {
+	c.mx.Lock()
+	c.onAdvance = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Follows the nodes that the user has to skip
+	Returns true if the limit of transitions has been reached
+*/
+func (c *Chain) skip(node *Node, m *tb.Message, to tb.Recipient) (*Node, bool) {
+	limit := c.settings().maxTransitions
+	for i := 0; node != nil && node.skipIf != nil && node.skipIf(node, to); i++ {
+		if limit > 0 && i >= limit {
+			return node, true
+		}
+		node = node.route(m, to)
+	}
+	return node, false
+}
+
+/*
+	Sets how many nodes may be skipped while processing a single message, 100 by default
+	It's a safety valve against skip conditions that lead users in circles.
+	Once the limit is reached the user stays on the node the flow has stopped at
+*/
+func (c *Chain) SetMaxTransitionsPerMessage(n int) *Chain {
+	c.mx.Lock()
+	c.maxTransitions = n
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers when the limit of transitions per message is reached
+*/
+func (c *Chain) OnLoopDetected(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onLoopDetected = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Makes the flow send the prompt of a node the user has moved to
+	Nodes without a prompt are left to their endpoints, so the endpoints sending messages on their own keep working
+*/
+func (c *Chain) SetAutoPrompt(enabled bool) *Chain {
+	c.mx.Lock()
+	c.autoPrompt = enabled
+	c.unlock()
+	return c
+}
+
+/*
+	Counts an attempt of the user that didn't advance and detects if the user got stuck
+*/
+func (c *Chain) stay(of tb.Recipient, node *Node) {
+	cfg := c.settings()
+	stuckAttempts, onStuck := cfg.stuckAttempts, cfg.onStuck
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok || s.node != node {
+		sh.mx.Unlock()
+		return
+	}
+	s.attempts++
+	attempts := s.attempts
+	stuck := !s.stuck && ((stuckAttempts > 0 && attempts >= stuckAttempts) ||
+		(node.dwell > 0 && time.Since(s.arrived) >= node.dwell))
+	if stuck {
+		// fire only once per episode
+		s.stuck = true
+	}
+	sh.mx.Unlock()
+	if stuck && onStuck != nil {
+		onStuck(node, of.Recipient(), attempts)
+	}
+}
+
+/*
+	Makes the flow delete the previous prompt it has sent to the user once the user advances,
+	so that the next prompt replaces it. Only the messages of the bot are deleted,
+	deletion failures like for messages that are too old are ignored.
+	Nodes with a sender are left alone as the sender may want to edit the previous prompt
+*/
+func (c *Chain) SetDeletePreviousPrompt(enabled bool) *Chain {
+	c.mx.Lock()
+	c.deletePrevious = enabled
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a number of consecutive attempts that didn't advance after which a user is considered stuck
+*/
+func (c *Chain) SetStuckAttempts(attempts int) *Chain {
+	c.mx.Lock()
+	c.stuckAttempts = attempts
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers once when a user gets stuck on a node
+	A user is stuck after too many attempts (see SetStuckAttempts)
+	or after staying on a node for longer than its dwell threshold (see Node.SetDwellThreshold)
+	The callback fires again only after the user has advanced
+*/
+func (c *Chain) OnStuck(callback StuckCallback) *Chain {
+	c.mx.Lock()
+	c.onStuck = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the number of the current attempt of the user on the node, i.e. the attempts that didn't advance plus one,
+	it's available to the text functions and the branches, see Node.AddBranchAttempts.
+	The count starts over once the user reaches another node or with ResetRetries, it's zero for users not in the flow
+*/
+func (c *Chain) Attempts(of tb.Recipient) int {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return 0
+	}
+	return s.attempts + 1
+}
+
+/*
+	Forgives the failed attempts of the user on the current node
+	The stuck detection starts over as well, it's a no-op for users that are not in the flow
+*/
+func (c *Chain) ResetRetries(of tb.Recipient) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		s.attempts = 0
+		s.stuck = false
+	}
+	sh.mx.Unlock()
 }
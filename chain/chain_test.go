@@ -0,0 +1,140 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Creates a flow that doesn't call the bot API with nodes that advance on any text
+*/
+func newTestFlow(t *testing.T, ids ...string) *Chain {
+	t.Helper()
+	flow, err := NewChainFlow("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow.SetDryRun(true)
+	node := flow.GetRoot()
+	for _, id := range ids {
+		node = node.Then(id, func(e *Node, m *tb.Message) *Node {
+			return e.Next()
+		}, tb.OnText)
+	}
+	return flow
+}
+
+/*
+	Creates a text message of a user
+*/
+func textOf(user *tb.User, text string) *tb.Message {
+	return &tb.Message{Sender: user, Chat: &tb.Chat{ID: int64(user.ID), Type: tb.ChatPrivate}, Text: text}
+}
+
+/*
+	Gets the ID of the node the user is on or an empty string
+*/
+func positionOf(flow *Chain, of tb.Recipient) string {
+	id, _ := flow.GetPositionID(of)
+	return id
+}
+
+func TestSwapBotWhileProcessing(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		user := &tb.User{ID: i}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				flow.Start(user, "hello")
+				flow.Process(textOf(user, "answer"))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			// the race detector reports unsynchronized access to the bot
+			flow.SetBot(&tb.Bot{})
+		}
+	}()
+	wg.Wait()
+	if flow.GetBot() == nil {
+		t.Error("the bot was not swapped")
+	}
+}
+
+func TestCyclicSkipsHitTheLimit(t *testing.T) {
+	flow := newTestFlow(t, "start", "a", "b")
+	user := &tb.User{ID: 1}
+	always := func(e *Node, to tb.Recipient) bool {
+		return true
+	}
+	a, _ := flow.Search("a")
+	b, _ := flow.Search("b")
+	a.SkipIf(always).Else(b)
+	b.SkipIf(always).Else(a)
+	loops := 0
+	flow.SetMaxTransitionsPerMessage(10).OnLoopDetected(func(recipient tb.Recipient, last *Node) {
+		loops++
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		flow.Process(textOf(user, "answer"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the skips are still going in circles")
+	}
+	if loops != 1 {
+		t.Errorf("expected the loop detected once, got %d", loops)
+	}
+	if id := positionOf(flow, user); id != "a" && id != "b" {
+		t.Errorf("expected the user to stop inside the loop, got %q", id)
+	}
+}
+
+func TestCallSendOptionsOverrideBareNodeOptions(t *testing.T) {
+	nodeMarkup, callMarkup := &tb.ReplyMarkup{}, &tb.ReplyMarkup{}
+	options := mergeSendOptions(&tb.SendOptions{ParseMode: tb.ModeMarkdown}, []interface{}{
+		nodeMarkup, tb.ModeHTML, tb.Silent,
+		&tb.SendOptions{ReplyMarkup: callMarkup, ParseMode: tb.ModeMarkdownV2},
+	})
+	if len(options) != 1 {
+		t.Fatalf("expected the options merged into one, got %d", len(options))
+	}
+	merged, _ := options[0].(*tb.SendOptions)
+	if merged == nil {
+		t.Fatalf("expected send options, got %T", options[0])
+	}
+	if merged.ReplyMarkup != callMarkup || merged.ParseMode != tb.ModeMarkdownV2 || !merged.DisableNotification {
+		t.Errorf("the call options don't take precedence, got %+v", merged)
+	}
+	options = mergeSendOptions(nil, []interface{}{&tb.SendOptions{ReplyMarkup: nodeMarkup}, tb.ForceReply})
+	if merged := options[0].(*tb.SendOptions); merged.ReplyMarkup == nodeMarkup || !merged.ReplyMarkup.ForceReply {
+		t.Errorf("expected a forced reply on a copy of the markup, got %+v", merged.ReplyMarkup)
+	}
+}
+
+func TestHandledDependsOnOutcomeOnly(t *testing.T) {
+	// e.g. the user has advanced but the prompt of the next node failed to send
+	failed := ProcessResult{Outcome: Advanced, Err: ErrFlowClosed}
+	if !failed.Handled() {
+		t.Error("a message the user has advanced with is not handled because of a later error")
+	}
+	for _, outcome := range []Outcome{NotActive, Passed, Rejected, Dropped, Queued, Paused} {
+		if (ProcessResult{Outcome: outcome}).Handled() {
+			t.Errorf("outcome %v is handled", outcome)
+		}
+	}
+}
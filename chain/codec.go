@@ -0,0 +1,150 @@
+package chain
+
+import (
+	"encoding/json"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"sort"
+)
+
+/*
+	Codec turns the data collected for a user into bytes and back
+	Keys are always strings, the codec must be able to handle every type of value stored with SetData
+*/
+type Codec interface {
+	Marshal(data map[string]interface{}) ([]byte, error)
+	Unmarshal(raw []byte) (map[string]interface{}, error)
+}
+
+/*
+	A default codec that uses JSON
+	Be aware that JSON turns numbers into float64 and custom types into maps
+*/
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(data map[string]interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (jsonCodec) Unmarshal(raw []byte) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+	Sets a codec that is used to export and import the user data, JSON is used by default
+*/
+func (c *Chain) SetDataCodec(codec Codec) *Chain {
+	c.mx.Lock()
+	c.codec = codec
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the codec used for the user data
+*/
+func (c *Chain) getCodec() Codec {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	if c.codec == nil {
+		return jsonCodec{}
+	}
+	return c.codec
+}
+
+/*
+	Encodes all the data collected for the user with the flow codec
+*/
+func (c *Chain) ExportData(of tb.Recipient) ([]byte, error) {
+	data, ok := c.GetAllData(of)
+	if !ok {
+		return nil, ErrUserNotInFlow
+	}
+	return c.getCodec().Marshal(data)
+}
+
+/*
+	Decodes the data with the flow codec and replaces the data collected for the user
+*/
+func (c *Chain) ImportData(of tb.Recipient, raw []byte) error {
+	data, err := c.getCodec().Unmarshal(raw)
+	if err != nil {
+		return err
+	}
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return ErrUserNotInFlow
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	s.data = data
+	return nil
+}
+
+/*
+	Puts users on the nodes in bulk, e.g. to migrate from another state machine without restarting the users
+	The entries map recipients to node IDs, a step name is tried when there's no node with such ID (see Node.SetStepName).
+	Users already in the flow keep their data. No callbacks fire, no prompts are sent and the limit of sessions is not applied.
+	Returns the number of imported users and the sorted recipients whose step didn't resolve
+*/
+func (c *Chain) ImportPositions(entries map[string]string) (int, []string, error) {
+	if c.isClosed() {
+		return 0, nil, ErrFlowClosed
+	}
+	skipped := []string{}
+	resolved := make(map[*shard]map[string]*Node)
+	for recipient, step := range entries {
+		node, ok := c.resolveStep(step)
+		if !ok {
+			skipped = append(skipped, recipient)
+			continue
+		}
+		sh := c.shardOf(recipient)
+		if resolved[sh] == nil {
+			resolved[sh] = make(map[string]*Node)
+		}
+		resolved[sh][recipient] = node
+	}
+	sort.Strings(skipped)
+	track := c.tracksHistory()
+	imported := 0
+	// a single lock per shard instead of one per user
+	for sh, positions := range resolved {
+		sh.mx.Lock()
+		for recipient, node := range positions {
+			if s, ok := sh.sessions[recipient]; ok {
+				s.arrive(node)
+			} else {
+				sh.put(recipient, newSession(node, track))
+			}
+			imported++
+		}
+		sh.mx.Unlock()
+		for _, node := range positions {
+			c.totals.addReached(node)
+		}
+	}
+	return imported, skipped, nil
+}
+
+/*
+	Finds a node by ID or by step name
+*/
+func (c *Chain) resolveStep(step string) (*Node, bool) {
+	if node, ok := c.Search(step); ok {
+		return node, true
+	}
+	for node := c.root.next; node != nil; node = node.next {
+		if node.GetStepName() == step {
+			return node, true
+		}
+	}
+	return nil, false
+}
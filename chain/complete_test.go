@@ -0,0 +1,72 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestCancelledInEndpointIsNotCompleted(t *testing.T) {
+	flow := newTestFlow(t)
+	user := &tb.User{ID: 1}
+	flow.GetRoot().Then("only", func(e *Node, m *tb.Message) *Node {
+		e.GetFlow().Cancel(m.Sender)
+		return nil
+	}, tb.OnText)
+	completed := 0
+	flow.OnComplete(func(recipient tb.Recipient, last *Node) {
+		completed++
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "answer"))
+	if completed != 0 {
+		t.Errorf("OnComplete fired %d times for a cancelled user", completed)
+	}
+	if stats := flow.Stats(); stats.Completed != 0 || stats.Cancelled != 1 {
+		t.Errorf("expected only a cancel, got %+v", stats)
+	}
+}
+
+func TestCompletionStyles(t *testing.T) {
+	styles := map[string]func(flow *Chain){
+		"terminal node": func(flow *Chain) {
+			flow.GetRoot().Next().Then("done", nil, tb.OnText).SetPrompt("bye").Terminal()
+		},
+		"end of the chain": func(flow *Chain) {},
+		"nil from the endpoint": func(flow *Chain) {
+			flow.GetRoot().Next().SetEndpoint(func(e *Node, m *tb.Message) *Node {
+				return nil
+			})
+		},
+		"end node": func(flow *Chain) {
+			flow.GetRoot().Next().SetEndpoint(func(e *Node, m *tb.Message) *Node {
+				return e.GetFlow().End()
+			})
+		},
+	}
+	for name, configure := range styles {
+		t.Run(name, func(t *testing.T) {
+			flow := newTestFlow(t, "question")
+			configure(flow)
+			user := &tb.User{ID: 1}
+			var last *Node
+			flow.OnComplete(func(recipient tb.Recipient, node *Node) {
+				last = node
+			})
+			if err := flow.Start(user, "hello"); err != nil {
+				t.Fatal(err)
+			}
+			// the flow completes on the answer itself, not on one more message
+			if result := flow.ProcessDetailed(textOf(user, "answer")); result.Outcome != Completed {
+				t.Errorf("expected the answer to complete the flow, got outcome %v", result.Outcome)
+			}
+			if last == nil {
+				t.Error("OnComplete didn't fire")
+			}
+			if _, ok := flow.GetPosition(user); ok {
+				t.Error("the user is kept after the completion")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package chain
+
+import tb "gopkg.in/tucnak/telebot.v2"
+
+/*
+	Creates a following element in the list that asks the user to confirm with Yes/No inline buttons
+	A press of Yes moves the user to onYes, a press of No moves to onNo.
+	A nil target means the node that follows the confirmation when the button is pressed,
+	so the confirmation may be chained with Then like any other node.
+	The button labels are taken from the flow when the prompt is sent, see Chain.SetConfirmLabelsFunc
+*/
+func (e *Node) ThenConfirm(id string, text string, onYes, onNo *Node) *Node {
+	confirm := e.Then(id, nil, "")
+	confirm.SetPrompt(text)
+	confirm.SetSender(sendConfirm)
+	confirm.ExpectCallback(confirmed)
+	// the targets are kept as branches so that clones of the flow are routed to their own nodes
+	confirm.LabeledBranch("yes", never, onYes)
+	confirm.LabeledBranch("no", never, onNo)
+	return confirm
+}
+
+/*
+	Routes a press of a confirmation button to the branch with the same label
+*/
+func confirmed(e *Node, cb *tb.Callback) *Node {
+	answer := ParseCallbackData(cb.Data)["confirm"]
+	for _, b := range e.branches {
+		if answer != "" && b.label == answer {
+			if b.target == nil {
+				return e.next
+			}
+			return b.target
+		}
+	}
+	return e
+}
+
+/*
+	Sets the labels of the confirmation buttons, "Yes" and "No" by default
+*/
+func (c *Chain) SetConfirmLabels(yes, no string) *Chain {
+	return c.SetConfirmLabelsFunc(func(e *Node, to tb.Recipient) string {
+		return yes
+	}, func(e *Node, to tb.Recipient) string {
+		return no
+	})
+}
+
+/*
+	Sets functions that build the labels of the confirmation buttons per recipient, e.g. to translate them
+	An empty label or a nil function means the default label, see SetConfirmLabels
+*/
+func (c *Chain) SetConfirmLabelsFunc(yes, no TextFunc) *Chain {
+	c.mx.Lock()
+	c.confirmYes, c.confirmNo = yes, no
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the labels of the confirmation buttons of a node for a recipient
+*/
+func (c *Chain) confirmLabels(node *Node, to tb.Recipient) (yes, no string) {
+	c.mx.RLock()
+	yesFunc, noFunc := c.confirmYes, c.confirmNo
+	c.mx.RUnlock()
+	if yesFunc != nil {
+		yes = yesFunc(node, to)
+	}
+	if noFunc != nil {
+		no = noFunc(node, to)
+	}
+	if yes == "" {
+		yes = "Yes"
+	}
+	if no == "" {
+		no = "No"
+	}
+	return yes, no
+}
+
+/*
+	Sends the prompt of a confirmation node with Yes/No inline buttons
+*/
+func sendConfirm(ctx SendContext) (*tb.Message, error) {
+	yes, no := ctx.Node.flow.confirmLabels(ctx.Node, ctx.Recipient)
+	markup := &tb.ReplyMarkup{
+		InlineKeyboard: [][]tb.InlineButton{{
+			{Text: yes, Data: EncodeCallbackData(map[string]string{"confirm": "yes"})},
+			{Text: no, Data: EncodeCallbackData(map[string]string{"confirm": "no"})},
+		}},
+	}
+	// the markup goes last so that it replaces the one from the default options
+	return ctx.Bot.Send(ctx.Recipient, ctx.Text, append(ctx.Options, markup)...)
+}
+
+/*
+	A guard that never matches, it only makes a transition visible to Node.Branches and ToDOT
+*/
+func never(m *tb.Message) bool {
+	return false
+}
@@ -0,0 +1,68 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestConfirmLabelsPerRecipient(t *testing.T) {
+	flow := newTestFlow(t, "first")
+	first, _ := flow.Search("first")
+	confirm := first.ThenConfirm("sure", "Sure?", nil, nil)
+	if yes, no := flow.confirmLabels(confirm, &tb.User{ID: 1}); yes != "Yes" || no != "No" {
+		t.Errorf("default labels are %q and %q", yes, no)
+	}
+	flow.SetConfirmLabelsFunc(func(e *Node, to tb.Recipient) string {
+		if to.Recipient() == "2" {
+			return "Ja"
+		}
+		return "Yes!"
+	}, nil)
+	if yes, no := flow.confirmLabels(confirm, &tb.User{ID: 1}); yes != "Yes!" || no != "No" {
+		t.Errorf("labels of the first user are %q and %q", yes, no)
+	}
+	if yes, _ := flow.confirmLabels(confirm, &tb.User{ID: 2}); yes != "Ja" {
+		t.Errorf("the yes label of the second user is %q", yes)
+	}
+	flow.SetConfirmLabels("Sure", "Nope")
+	if yes, no := flow.confirmLabels(confirm, &tb.User{ID: 2}); yes != "Sure" || no != "Nope" {
+		t.Errorf("fixed labels are %q and %q", yes, no)
+	}
+}
+
+func TestConfirmRoutesPresses(t *testing.T) {
+	flow := newTestFlow(t, "first")
+	first, _ := flow.Search("first")
+	first.ThenConfirm("sure", "Sure?", nil, first).Then("after", func(e *Node, m *tb.Message) *Node {
+		return e.Next()
+	}, tb.OnText)
+	press := func(user *tb.User, answer string) {
+		t.Helper()
+		cb := pressOf(user)
+		cb.Data = EncodeCallbackData(map[string]string{"confirm": answer})
+		if !flow.ProcessCallback(cb) {
+			t.Fatalf("the press of %q was not processed", answer)
+		}
+	}
+	for _, c := range []struct {
+		answer   string
+		expected string
+	}{
+		{"yes", "after"},
+		{"no", "first"},
+		{"maybe", "sure"},
+	} {
+		user := &tb.User{ID: 1}
+		if err := flow.Start(user, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		flow.Process(textOf(user, "answer"))
+		if id := positionOf(flow, user); id != "sure" {
+			t.Fatalf("expected the user on the confirmation, got %q", id)
+		}
+		press(user, c.answer)
+		if id := positionOf(flow, user); id != c.expected || !flow.IsActive(user) {
+			t.Errorf("a press of %q moved the user to %q instead of %q", c.answer, id, c.expected)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"strings"
+	"time"
+)
+
+/*
+	Layouts ExpectDate accepts when none are given
+*/
+var DefaultDateLayouts = []string{"2006-01-02 15:04", "2006-01-02", "02.01.2006 15:04", "02.01.2006"}
+
+/*
+	Makes the node expect a date in the text, it's parsed in the timezone of the user, see Chain.SetUserTimezone
+	A parsed date is stored as a time.Time by the node ID, see Chain.AnswerTime, other input is invalid
+*/
+func (e *Node) ExpectDate(layouts ...string) *Node {
+	if len(layouts) == 0 {
+		layouts = DefaultDateLayouts
+	}
+	e.event = tb.OnText
+	e.dateLayouts = layouts
+	return e
+}
+
+/*
+	Parses a date with the first matching layout
+*/
+func (e *Node) parseDate(text string, loc *time.Location) (time.Time, bool) {
+	text = strings.TrimSpace(text)
+	for _, layout := range e.dateLayouts {
+		if t, err := time.ParseInLocation(layout, text, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/*
+	Sets the timezone of the user that is used to parse and render dates, UTC is used by default
+	The timezone is kept with the user state, so it's cleared when the user leaves the flow
+	Returns false if the user is not in the flow
+*/
+func (c *Chain) SetUserTimezone(of tb.Recipient, loc *time.Location) bool {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return false
+	}
+	s.location = loc
+	return true
+}
+
+/*
+	Gets the timezone of the user
+*/
+func (c *Chain) UserTimezone(of tb.Recipient) *time.Location {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	if s, ok := sh.sessions[of.Recipient()]; ok && s.location != nil {
+		return s.location
+	}
+	return time.UTC
+}
+
+/*
+	Renders a date in the timezone of the user
+*/
+func (c *Chain) FormatDate(of tb.Recipient, t time.Time, layout string) string {
+	return t.In(c.UserTimezone(of)).Format(layout)
+}
+
+/*
+	Retrieves an answer stored for a node as a date
+	Returns false if there's no answer or it's of a different type
+*/
+func (c *Chain) AnswerTime(of tb.Recipient, nodeId string) (time.Time, bool) {
+	value, _ := c.GetData(of, nodeId)
+	answer, ok := value.(time.Time)
+	return answer, ok
+}
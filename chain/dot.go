@@ -0,0 +1,56 @@
+package chain
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+	Exports the chain as a graph in the DOT language, e.g. to render it with Graphviz
+	Nodes are named by their labels, branches are drawn dashed and the else targets dotted.
+	Names of the validators added to a node are listed in its tooltip
+*/
+func (c *Chain) ToDOT() string {
+	var b strings.Builder
+	b.WriteString("digraph " + strconv.Quote(c.id) + " {\n")
+	for node := c.root.next; node != nil; node = node.next {
+		attributes := "label=" + strconv.Quote(node.GetLabel())
+		var checks []string
+		for _, name := range node.Validators() {
+			if name != "" {
+				checks = append(checks, name)
+			}
+		}
+		if len(checks) > 0 {
+			attributes += ", tooltip=" + strconv.Quote(strings.Join(checks, ", "))
+		}
+		b.WriteString("\t" + strconv.Quote(node.id) + " [" + attributes + "];\n")
+	}
+	edge := func(from, to *Node, attributes string) {
+		b.WriteString("\t" + strconv.Quote(from.id) + " -> " + strconv.Quote(to.id))
+		if attributes != "" {
+			b.WriteString(" [" + attributes + "]")
+		}
+		b.WriteString(";\n")
+	}
+	for node := c.root.next; node != nil; node = node.next {
+		for _, br := range node.branches {
+			if br.target == nil {
+				continue
+			}
+			attributes := "style=dashed"
+			if br.label != "" {
+				attributes += ", label=" + strconv.Quote(br.label)
+			}
+			edge(node, br.target, attributes)
+		}
+		if node.fallback != nil {
+			edge(node, node.fallback, "style=dotted, label=\"else\"")
+		}
+		if node.next != nil {
+			edge(node, node.next, "")
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package chain
+
+import tb "gopkg.in/tucnak/telebot.v2"
+
+/*
+	Actions the flow performs against the bot API
+*/
+const (
+	ActionSend    = "send"
+	ActionEdit    = "edit"
+	ActionMarkup  = "markup"
+	ActionDelete  = "delete"
+	ActionRespond = "respond"
+)
+
+/*
+	A call to the bot API the flow would have made
+	What is the text or the sendable for sends and edits, the markup for markup edits
+	and the callback response for answers to callbacks
+*/
+type OutgoingMessage struct {
+	Action    string
+	Recipient string
+	Node      *Node
+	What      interface{}
+	Options   []interface{}
+}
+
+/*
+	Reports a call to the bot API instead of making it if the calls are intercepted
+	Returns false if the call has to be made
+*/
+func (c *Chain) intercept(msg OutgoingMessage) bool {
+	cfg := c.settings()
+	outgoing, dryRun, onSuppressed := cfg.outgoing, cfg.dryRun, cfg.onSuppressed
+	if outgoing != nil {
+		outgoing(msg)
+		return true
+	}
+	if !dryRun {
+		return false
+	}
+	if onSuppressed != nil {
+		onSuppressed(msg)
+	}
+	return true
+}
+
+/*
+	Makes the flow process messages as usual but suppress all its calls to the bot API,
+	e.g. to replay production messages against a staging flow. Positions and data are updated as usual.
+	Suppressed calls are reported to the OnSuppressed callback, nodes with a sender are reported as plain sends
+	of their prompts as the sender is not called. Only the calls made by the flow itself
+	are suppressed, whatever endpoints do on their own (sending messages, writing to a database) is not
+*/
+func (c *Chain) SetDryRun(enabled bool) *Chain {
+	c.mx.Lock()
+	c.dryRun = enabled
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that receives the calls to the bot API suppressed in the dry-run mode, see SetDryRun
+*/
+func (c *Chain) OnSuppressed(callback func(msg OutgoingMessage)) *Chain {
+	c.mx.Lock()
+	c.onSuppressed = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Predicts what would happen if the user sent the message right now without changing any state
+	The message is processed by a copy of the flow with a copy of the user state, and the calls to the bot API
+	are captured instead of being made. Nodes with a sender are captured as plain sends of their prompts.
+	The flow callbacks are not fired, however endpoints run as usual, so whatever they do on their own
+	(e.g. sending messages with the bot or changing the flow data) is not prevented.
+	The state of of is used for the message whoever has sent it, e.g. for an admin previewing the flow of a user
+*/
+func (c *Chain) DryRun(of tb.Recipient, m *tb.Message) (ProcessResult, []OutgoingMessage, error) {
+	if m == nil {
+		return ProcessResult{Outcome: NotActive}, nil, nil
+	}
+	dry := c.Clone(c.id)
+	var sent []OutgoingMessage
+	dry.mx.Lock()
+	// side effects of the flow callbacks can't be undone
+	dry.onCancel, dry.onComplete, dry.onRestart = nil, nil, nil
+	dry.onStuck, dry.onAdvance, dry.onLoopDetected = nil, nil, nil
+	dry.onTimeout, dry.onNodeTimeout, dry.onPosition = nil, nil, nil
+	dry.onCompleteData, dry.onDuration, dry.onAudit = nil, nil, nil
+	dry.alreadyDone, dry.onEvict, dry.onStart = nil, nil, nil
+	dry.outgoing = func(msg OutgoingMessage) {
+		msg.Node = c.original(msg.Node)
+		sent = append(sent, msg)
+	}
+	dry.unlock()
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	s, ok := sh.sessions[of.Recipient()]
+	var copied session
+	if ok {
+		copied = *s
+		copied.data = make(map[string]interface{}, len(s.data))
+		for key, value := range s.data {
+			copied.data[key] = value
+		}
+		if s.history != nil {
+			copied.history = append([]string{}, s.history...)
+		}
+	}
+	sh.mx.RUnlock()
+	if !ok {
+		return ProcessResult{Outcome: NotActive}, nil, ErrUserNotInFlow
+	}
+	if copied.node != nil {
+		copied.node, _ = dry.Search(copied.node.id)
+	}
+	copied.busy, copied.queue = false, nil
+	// the copy is found by the key of the message, it may differ from of
+	key := dry.keyOf(m).Recipient()
+	dry.shardOf(key).put(key, &copied)
+	result := dry.handle(c.GetBot(), m)
+	result.From, result.To = c.original(result.From), c.original(result.To)
+	return result, sent, nil
+}
+
+/*
+	Gets the node of the flow a node of its copy stands for
+*/
+func (c *Chain) original(node *Node) *Node {
+	if node == nil || node.flow == c {
+		return node
+	}
+	if node.end {
+		return c.end
+	}
+	if original, ok := c.Search(node.id); ok {
+		return original
+	}
+	return node
+}
@@ -0,0 +1,73 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestDryRunSkipsSenders(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	called := false
+	second, _ := flow.Search("second")
+	second.SetPrompt("second?").SetSender(func(ctx SendContext) (*tb.Message, error) {
+		called = true
+		return ctx.Bot.Send(ctx.Recipient, ctx.Text)
+	})
+	flow.SetAutoPrompt(true)
+	var suppressed []OutgoingMessage
+	flow.OnSuppressed(func(msg OutgoingMessage) {
+		suppressed = append(suppressed, msg)
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "answer"))
+	if called {
+		t.Error("the sender was called in the dry-run mode")
+	}
+	if len(suppressed) != 2 || suppressed[1].What != "second?" {
+		t.Errorf("expected the prompt reported as a send, got %+v", suppressed)
+	}
+}
+
+func TestDryRunWithMessageOfAnotherUser(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user, admin := &tb.User{ID: 1}, &tb.User{ID: 2}
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := flow.DryRun(user, textOf(admin, "answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != Advanced || result.To == nil || result.To.GetId() != "second" {
+		t.Errorf("expected the preview to advance to second, got outcome %v to %v", result.Outcome, result.To)
+	}
+	if id := positionOf(flow, user); id != "first" {
+		t.Errorf("the dry run moved the user to %q", id)
+	}
+	if flow.IsActive(admin) {
+		t.Error("the dry run put the admin into the flow")
+	}
+}
+
+func TestDryRunCapturesWithoutDryRunMode(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	second, _ := flow.Search("second")
+	second.SetPrompt("second?")
+	flow.SetAutoPrompt(true)
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// the flow has no bot, so any call that is not captured fails the test
+	flow.SetDryRun(false)
+	result, sent, err := flow.DryRun(user, textOf(user, "answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != Advanced || len(sent) != 1 || sent[0].What != "second?" {
+		t.Errorf("expected the prompt of second captured, got outcome %v and %+v", result.Outcome, sent)
+	}
+}
@@ -0,0 +1,115 @@
+package chain
+
+import tb "gopkg.in/tucnak/telebot.v2"
+
+/*
+	Defines what happens to a message of a user that arrives while the previous one is still processed,
+	e.g. while the prompt of the next node is being sent
+*/
+type InFlightPolicy int
+
+const (
+	InFlightAllow InFlightPolicy = iota // messages are processed concurrently, it's the default
+	InFlightDrop                        // messages are dropped
+	InFlightQueue                       // messages are queued and processed in order once the previous one is done
+)
+
+/*
+	Sets the in-flight policy, messages are processed concurrently by default
+	Queued messages are replayed by the call that was processing the first message, so its Process returns
+	only after all of them. Queued messages are discarded if the user leaves the flow meanwhile
+*/
+func (c *Chain) SetInFlightPolicy(policy InFlightPolicy) *Chain {
+	c.mx.Lock()
+	c.inFlight = policy
+	c.unlock()
+	return c
+}
+
+/*
+	Marks the user as busy with the message
+	Returns false with the outcome for the message if the user is busy already,
+	owner is the session that was marked, it's nil if there was nothing to mark, see release
+*/
+func (c *Chain) acquire(of tb.Recipient, m *tb.Message, policy InFlightPolicy) (outcome Outcome, owner *session, ok bool) {
+	key := of.Recipient()
+	sh := c.shardOf(key)
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, active := sh.sessions[key]
+	if !active {
+		// the user is not in the flow, there's nothing to guard
+		return NotActive, nil, true
+	}
+	if !s.busy {
+		s.busy = true
+		return NotActive, s, true
+	}
+	if policy == InFlightQueue {
+		s.queue = append(s.queue, m)
+		return Queued, nil, false
+	}
+	return Dropped, nil, false
+}
+
+/*
+	Takes the next queued message of the user or marks the user as no longer busy
+	It's a no-op once the user has left the flow or has been restarted with a new session,
+	the mark of the new session belongs to the call that has set it
+*/
+func (c *Chain) release(of tb.Recipient, owner *session) *tb.Message {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok || s != owner {
+		return nil
+	}
+	if len(s.queue) > 0 {
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		return next
+	}
+	s.busy = false
+	return nil
+}
+
+/*
+	Marks the user as being started, so the messages of the user wait until the initial position is set
+	Concurrent starts for the same user are done one after another
+*/
+func (c *Chain) beginStart(of tb.Recipient) func() {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	for {
+		pending, ok := sh.starting[of.Recipient()]
+		if !ok {
+			break
+		}
+		sh.mx.Unlock()
+		<-pending
+		sh.mx.Lock()
+	}
+	done := make(chan struct{})
+	sh.starting[of.Recipient()] = done
+	sh.mx.Unlock()
+	return func() {
+		sh.mx.Lock()
+		delete(sh.starting, of.Recipient())
+		sh.mx.Unlock()
+		close(done)
+	}
+}
+
+/*
+	Waits until the user is not being started anymore
+*/
+func (c *Chain) awaitStart(of tb.Recipient) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	pending, ok := sh.starting[of.Recipient()]
+	sh.mx.RUnlock()
+	if ok {
+		<-pending
+	}
+}
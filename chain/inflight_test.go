@@ -0,0 +1,151 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+	"time"
+)
+
+func TestProcessWaitsForStart(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	processed := make(chan ProcessResult, 1)
+	flow.OnSuppressed(func(msg OutgoingMessage) {
+		if msg.Node != nil {
+			return
+		}
+		// the user answers while the initial message is still being sent
+		go func() {
+			processed <- flow.ProcessDetailed(textOf(user, "answer"))
+		}()
+		select {
+		case result := <-processed:
+			t.Errorf("the message was processed before the start, outcome %v", result.Outcome)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-processed:
+		if result.Outcome != Advanced {
+			t.Errorf("expected the first answer to advance, got outcome %v", result.Outcome)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message is still waiting after the start")
+	}
+	if id := positionOf(flow, user); id != "second" {
+		t.Errorf("expected the user on second, got %q", id)
+	}
+}
+
+func TestRestartFromOnRestart(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	flow.SetRestartPolicy(Confirm)
+	flow.OnRestart(func(recipient tb.Recipient, last *Node) {
+		flow.Cancel(recipient)
+		flow.Start(recipient, "over")
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "answer"))
+	done := make(chan struct{})
+	go func() {
+		flow.Start(user, "again")
+		flow.Process(textOf(user, "answer"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the restart is still hanging")
+	}
+	if id := positionOf(flow, user); id != "second" {
+		t.Errorf("expected the user started over and on second, got %q", id)
+	}
+}
+
+func TestReleaseOnlyOwnInFlightMark(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	// a call for a user who is not in the flow yet has nothing to release
+	if _, owner, ok := flow.acquire(user, textOf(user, "stranger"), InFlightQueue); !ok || owner != nil {
+		t.Fatalf("expected nothing marked for a stranger, got owner %v", owner)
+	}
+	flow.Enter(user)
+	_, owner, _ := flow.acquire(user, textOf(user, "busy"), InFlightQueue)
+	if owner == nil {
+		t.Fatal("expected the user marked")
+	}
+	busy := func() bool {
+		sh := flow.shardOf(user.Recipient())
+		sh.mx.RLock()
+		defer sh.mx.RUnlock()
+		return sh.sessions[user.Recipient()].busy
+	}
+	if flow.release(user, nil); !busy() {
+		t.Error("the mark was released by a call that hasn't set it")
+	}
+	if flow.release(user, owner); busy() {
+		t.Error("the mark was not released by its owner")
+	}
+}
+
+func TestRestartInEndpointKeepsNewInFlightMark(t *testing.T) {
+	flow := newTestFlow(t)
+	flow.SetInFlightPolicy(InFlightQueue)
+	user := &tb.User{ID: 1}
+	queued := textOf(user, "queued")
+	flow.GetRoot().Then("first", func(e *Node, m *tb.Message) *Node {
+		if m.Text == "restart" {
+			// the user starts over and another call takes the new session while this one is processed
+			flow.Start(m.Sender, "again")
+			flow.acquire(user, textOf(user, "busy"), InFlightQueue)
+			flow.acquire(user, queued, InFlightQueue)
+		}
+		return e
+	}, tb.OnText)
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "restart"))
+	sh := flow.shardOf(user.Recipient())
+	sh.mx.RLock()
+	s := sh.sessions[user.Recipient()]
+	busy, queue := s.busy, len(s.queue)
+	sh.mx.RUnlock()
+	if !busy || queue != 1 {
+		t.Errorf("the mark of the restarted session was released, busy %v with %d queued", busy, queue)
+	}
+}
+
+func TestFilteredMessagesBypassInFlightPolicy(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	flow.SetInFlightPolicy(InFlightQueue).SetChatTypes(tb.ChatPrivate)
+	flow.SetUpdateFilter(func(m *tb.Message) bool {
+		return m.Text != "filtered"
+	})
+	user := &tb.User{ID: 1}
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// the user is busy with another message
+	flow.acquire(user, textOf(user, "busy"), InFlightQueue)
+	group := textOf(user, "group")
+	group.Chat = &tb.Chat{ID: -1, Type: tb.ChatGroup}
+	for _, m := range []*tb.Message{group, textOf(user, "filtered")} {
+		if result := flow.ProcessDetailed(m); result.Outcome != NotActive {
+			t.Errorf("%q: expected the message ignored, got outcome %v", m.Text, result.Outcome)
+		}
+	}
+	sh := flow.shardOf(user.Recipient())
+	sh.mx.RLock()
+	queue := len(sh.sessions[user.Recipient()].queue)
+	sh.mx.RUnlock()
+	if queue != 0 {
+		t.Errorf("%d ignored messages were queued", queue)
+	}
+}
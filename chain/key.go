@@ -0,0 +1,67 @@
+package chain
+
+import tb "gopkg.in/tucnak/telebot.v2"
+
+/*
+	Sets a function that picks the key the position of a message is tracked by, the sender is used by default
+	The key is used as a recipient too, so it should be a valid one, e.g. the chat ID to run a flow for a whole group.
+	An empty key falls back to the sender
+*/
+func (c *Chain) SetKeyFunc(keyFunc func(m *tb.Message) string) *Chain {
+	c.mx.Lock()
+	c.keyFunc = keyFunc
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a function that picks the key the position of a callback is tracked by, see SetKeyFunc
+	Without it the key function of the messages is applied to the sender and the chat of the callback,
+	so a user who has started with a message is matched when they tap a button
+*/
+func (c *Chain) SetCallbackKeyFunc(keyFunc func(cb *tb.Callback) string) *Chain {
+	c.mx.Lock()
+	c.callbackKey = keyFunc
+	c.unlock()
+	return c
+}
+
+/*
+	Gets the recipient the position of the message is tracked by
+*/
+func (c *Chain) keyOf(m *tb.Message) tb.Recipient {
+	return c.settings().keyOf(m)
+}
+
+/*
+	Gets the recipient the position of the message is tracked by with the settings of a particular call
+*/
+func (cfg *settings) keyOf(m *tb.Message) tb.Recipient {
+	if cfg.keyFunc != nil {
+		if key := cfg.keyFunc(m); key != "" {
+			return recipientId(key)
+		}
+	}
+	return m.Sender
+}
+
+/*
+	Gets the recipient the position of the callback is tracked by
+*/
+func (c *Chain) callbackKeyOf(cb *tb.Callback) tb.Recipient {
+	cfg := c.settings()
+	keyFunc, callbackKey := cfg.keyFunc, cfg.callbackKey
+	if callbackKey != nil {
+		if key := callbackKey(cb); key != "" {
+			return recipientId(key)
+		}
+		return cb.Sender
+	}
+	if keyFunc != nil {
+		// the callback is seen as a message of the same user in the chat of the button
+		if key := keyFunc(callbackMessage(cb)); key != "" {
+			return recipientId(key)
+		}
+	}
+	return cb.Sender
+}
@@ -2,6 +2,7 @@ package chain
 
 import (
 	tb "gopkg.in/tucnak/telebot.v2"
+	"time"
 )
 
 /*
@@ -9,16 +10,160 @@ import (
 */
 type Callback func(e *Node, c *tb.Message) *Node
 
+/*
+	Callback function declaration for nodes that expect an inline query
+	The endpoint is supposed to answer the query and return the next node
+*/
+type QueryCallback func(e *Node, q *tb.Query) *Node
+
+/*
+	Function declaration that produces a text of a node for a particular user
+*/
+type TextFunc func(e *Node, to tb.Recipient) string
+
+/*
+	Everything a sender needs to render the prompt of a node
+	Options already include the default send options of the flow,
+	Media is the media of the prompt with Text as its caption or nil, see Node.SetPromptMedia.
+	Last is the previous prompt sent to the user and may be nil
+*/
+type SendContext struct {
+	Bot       *tb.Bot
+	Recipient tb.Recipient
+	Node      *Node
+	Text      string
+	Media     tb.Sendable
+	Options   []interface{}
+	Last      *tb.Message
+}
+
+/*
+	Sender function declaration that delivers the prompt of a node to a user
+*/
+type Sender func(ctx SendContext) (*tb.Message, error)
+
+/*
+	Condition function declaration that decides if a user should skip a node
+*/
+type SkipCondition func(e *Node, to tb.Recipient) bool
+
+/*
+	Validator function declaration that checks the input of a node
+	A returned error is sent back to the user who stays on the node
+*/
+type Validator func(m *tb.Message) error
+
+/*
+	Validator function declaration that checks the input against the data the user has collected
+	The data is a snapshot, changing it does not affect the flow
+*/
+type DataValidator func(m *tb.Message, data map[string]interface{}) error
+
+/*
+	Guard function declaration that decides if a branch should be taken for a message
+*/
+type Guard func(m *tb.Message) bool
+
+/*
+	Guard function declaration that decides on a branch using the data the user has collected as well
+	The data is a snapshot, changing it does not affect the flow
+*/
+type DataGuard func(m *tb.Message, data map[string]interface{}) bool
+
+/*
+	Guard function declaration that decides on a branch by the number of the attempt on the node as well,
+	the first answer on the node is attempt 1, see Chain.Attempts
+*/
+type AttemptGuard func(m *tb.Message, attempts int) bool
+
+/*
+	Creates a guard that matches a dice roll within a range, min and max included
+*/
+func DiceIn(min, max int) Guard {
+	return func(m *tb.Message) bool {
+		return m.Dice != nil && m.Dice.Value >= min && m.Dice.Value <= max
+	}
+}
+
+/*
+	A conditional transition to a target node
+*/
+type branch struct {
+	guard        Guard
+	dataGuard    DataGuard
+	attemptGuard AttemptGuard
+	target       *Node
+	label        string
+}
+
+/*
+	A read-only view of a conditional transition
+*/
+type BranchEdge struct {
+	Target *Node
+	Label  string
+}
+
 /*
 	Node is an element in a double-linked list
 */
 type Node struct {
-	id       string
-	flow     *Chain
-	endpoint Callback
-	prev     *Node
-	next     *Node
-	event    string
+	id            string
+	flow          *Chain
+	endpoint      Callback
+	prev          *Node
+	next          *Node
+	event         string
+	finish        *message
+	prompt        *message
+	textFunc      TextFunc
+	branches      []branch
+	fallback      *Node
+	dwell         time.Duration
+	timeout       time.Duration
+	sender        Sender
+	skipIf        SkipCondition
+	retry         *message
+	end           bool
+	onQuery       QueryCallback
+	onCallback    ButtonCallback
+	storeParams   bool
+	label         string
+	description   string
+	validator     Validator
+	dataValidator DataValidator
+	stepName      string
+	collect       *collector
+	minDelay      time.Duration
+	terminal      bool
+	help          string
+	dateLayouts   []string
+	validators    []namedValidator
+	media         tb.Sendable
+}
+
+/*
+	A validator added to a node with a name it's documented by
+*/
+type namedValidator struct {
+	name  string
+	check DataValidator
+}
+
+/*
+	A configuration of a node that collects several inputs
+*/
+type collector struct {
+	key   string
+	until Guard
+}
+
+/*
+	A message that is sent by the flow itself
+*/
+type message struct {
+	text    string
+	options []interface{}
 }
 
 /*
@@ -37,6 +182,159 @@ func (e *Node) Then(id string, endpoint Callback, expectedEvent string) *Node {
 	return newNode
 }
 
+/*
+	Makes the node expect an inline query instead of a message, see Chain.ProcessInlineQuery
+	The endpoint answers the query and returns the next node just like a regular endpoint does
+*/
+func (e *Node) ExpectInlineQuery(endpoint QueryCallback) *Node {
+	e.event = tb.OnQuery
+	e.onQuery = endpoint
+	return e
+}
+
+/*
+	Makes the node collect valid inputs until a message matching the predicate arrives, e.g. a "Done" command
+	Collected messages are appended to a slice of *tb.Message stored as the user data by the key,
+	see Chain.Collected. The data is cleared with the rest of the user data when the user leaves the flow.
+	The message matching the predicate is not collected, it's processed by the endpoint or the branches
+	like a regular input, so the user advances
+*/
+func (e *Node) Collect(key string, until func(m *tb.Message) bool) *Node {
+	e.collect = &collector{key: key, until: until}
+	return e
+}
+
+/*
+	Makes the flow complete as soon as a user reaches the node, its prompt is sent as the last message
+	Returning nil from an endpoint or reaching the end of the chain completes the flow right away as well
+*/
+func (e *Node) Terminal() *Node {
+	e.terminal = true
+	return e
+}
+
+/*
+	Makes the node terminal: on a valid input the text is sent and the flow is completed
+	A finishing node must not have an endpoint, see Chain.Validate
+*/
+func (e *Node) Finish(text string, options ...interface{}) *Node {
+	e.finish = &message{text: text, options: options}
+	return e
+}
+
+/*
+	Sets a prompt that the flow sends to ask the user for the node input
+	An empty text means no message is sent, the node just waits for the input
+*/
+func (e *Node) SetPrompt(text string, options ...interface{}) *Node {
+	e.flow.mx.Lock()
+	e.prompt = &message{text: text, options: options}
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Sets a media prompt, e.g. a document to confirm, the caption is the prompt text
+	The caption goes through the text function and the transformer like a text prompt does, so it may be localized.
+	The options, e.g. a keyboard, are sent along with the media. Photos, documents, videos, audios,
+	animations and voices get the caption, other media are sent as they are
+*/
+func (e *Node) SetPromptMedia(media tb.Sendable, caption string, options ...interface{}) *Node {
+	e.flow.mx.Lock()
+	e.media = media
+	e.prompt = &message{text: caption, options: options}
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Sets a message that the flow sends when the node rejects the input, e.g. a text instead of a dice roll
+*/
+func (e *Node) SetRetryMessage(text string, options ...interface{}) *Node {
+	e.retry = &message{text: text, options: options}
+	return e
+}
+
+/*
+	Sets a help text the user gets on the node by asking for help, see Chain.SetHelpTrigger
+*/
+func (e *Node) SetHelp(text string) *Node {
+	e.help = text
+	return e
+}
+
+/*
+	Sets a function that builds the prompt text dynamically
+	It takes precedence over the text set with SetPrompt, the prompt options are still used.
+	Returning an empty string means no message is sent, e.g. to show a warning only for first-time users
+*/
+func (e *Node) SetTextFunc(textFunc TextFunc) *Node {
+	e.textFunc = textFunc
+	return e
+}
+
+/*
+	Sets a function that delivers the prompt of the node instead of sending a new message,
+	e.g. to edit the previous prompt or delete it first
+*/
+func (e *Node) SetSender(sender Sender) *Node {
+	e.sender = sender
+	return e
+}
+
+/*
+	Checks if the node has a prompt configured
+*/
+func (e *Node) HasPrompt() bool {
+	return e.getPrompt() != nil || e.textFunc != nil || e.media != nil
+}
+
+/*
+	Gets the prompt message, it may be replaced at runtime with Chain.SetPrompt
+*/
+func (e *Node) getPrompt() *message {
+	return e.flow.nodeSettings(e).prompt
+}
+
+/*
+	Gets the prompt text of the node for the user
+*/
+func (e *Node) GetPromptText(to tb.Recipient) string {
+	if e.textFunc != nil {
+		return e.textFunc(e, to)
+	}
+	if prompt := e.getPrompt(); prompt != nil {
+		return prompt.text
+	}
+	return ""
+}
+
+/*
+	Sets for how long a user may stay on the node before being considered stuck
+*/
+func (e *Node) SetDwellThreshold(d time.Duration) *Node {
+	e.dwell = d
+	return e
+}
+
+/*
+	Makes the node reject answers that arrive sooner than the delay after the user has reached the node,
+	e.g. to discourage bots racing through a form. Such answers are treated as invalid input
+*/
+func (e *Node) MinResponseDelay(d time.Duration) *Node {
+	e.minDelay = d
+	return e
+}
+
+/*
+	Sets for how long a user may be inactive on the node before being removed from the flow
+	The node timeout is enforced by the reaper along with the flow timeout, see Chain.Expire
+*/
+func (e *Node) Timeout(d time.Duration) *Node {
+	e.timeout = d
+	return e
+}
+
 /*
 	Get related flow
 */
@@ -51,11 +349,138 @@ func (e *Node) GetId() string {
 	return e.id
 }
 
+/*
+	Sets a human-readable name of the node, e.g. for diagrams
+*/
+func (e *Node) SetLabel(label string) *Node {
+	e.label = label
+	return e
+}
+
+/*
+	Get node's label, the step name or the identificator is used when no label is set
+*/
+func (e *Node) GetLabel() string {
+	if e.label == "" {
+		return e.GetStepName()
+	}
+	return e.label
+}
+
+/*
+	Sets a name of the step the node represents for funnel reports, see Chain.Stats
+*/
+func (e *Node) SetStepName(name string) *Node {
+	e.stepName = name
+	return e
+}
+
+/*
+	Get node's step name, the identificator is used when no step name is set
+*/
+func (e *Node) GetStepName() string {
+	if e.stepName == "" {
+		return e.id
+	}
+	return e.stepName
+}
+
+/*
+	Sets a human-readable description of the node, e.g. for documentation
+*/
+func (e *Node) SetDescription(description string) *Node {
+	e.description = description
+	return e
+}
+
+/*
+	Get node's description
+*/
+func (e *Node) GetDescription() string {
+	return e.description
+}
+
 /*
 	Get node's callback endpoint
 */
 func (e *Node) GetEndpoint() Callback {
-	return e.endpoint
+	return e.flow.nodeSettings(e).endpoint
+}
+
+/*
+	Replaces node's callback endpoint, e.g. to wrap the existing one
+	It is safe to call while the flow is processing messages
+*/
+func (e *Node) SetEndpoint(endpoint Callback) *Node {
+	e.flow.mx.Lock()
+	e.endpoint = endpoint
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Sets a validator that checks the input before the endpoint or the branches get it
+	It is safe to call while the flow is processing messages
+*/
+func (e *Node) SetValidator(validator Validator) *Node {
+	e.flow.mx.Lock()
+	e.validator = validator
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Sets a validator that checks the input against the data the user has collected,
+	e.g. to compare the answer with an earlier one. It runs after the validator set with SetValidator.
+	It is safe to call while the flow is processing messages
+*/
+func (e *Node) SetValidatorData(validator DataValidator) *Node {
+	e.flow.mx.Lock()
+	e.dataValidator = validator
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Adds a validator that checks the input against the data the user has collected
+	A returned error is sent back to the user and the user stays on the node, nil lets the input through.
+	The added validators run in order after the ones set with SetValidator and SetValidatorData,
+	the first error stops the check. It is safe to call while the flow is processing messages
+*/
+func (e *Node) AddValidator(validator DataValidator) *Node {
+	return e.AddNamedValidator("", validator)
+}
+
+/*
+	Adds a validator like AddValidator does with a name that describes it, e.g. "max 100 chars",
+	the name is shown in the DOT export, see Validators
+*/
+func (e *Node) AddNamedValidator(name string, validator DataValidator) *Node {
+	e.flow.mx.Lock()
+	// a full slice expression keeps the copies of the node from sharing the validators
+	e.validators = append(e.validators[:len(e.validators):len(e.validators)], namedValidator{name: name, check: validator})
+	e.flow.unlock()
+	return e
+}
+
+/*
+	Gets the names of the validators added to the node in the order they run, unnamed ones are empty
+*/
+func (e *Node) Validators() []string {
+	e.flow.mx.RLock()
+	defer e.flow.mx.RUnlock()
+	names := make([]string, len(e.validators))
+	for i, validator := range e.validators {
+		names[i] = validator.name
+	}
+	return names
+}
+
+/*
+	Get node's validator
+*/
+func (e *Node) GetValidator() Validator {
+	return e.flow.nodeSettings(e).validator
 }
 
 /*
@@ -106,6 +531,167 @@ func (e *Node) SearchUp(nodeId string) (*Node, bool) {
 	return nil, false
 }
 
+/*
+	Adds a conditional transition to a target node
+	Branches are checked in the order they were added
+	A node without an endpoint follows its branches when processing a message,
+	an endpoint may follow them by returning ResolveNext
+*/
+func (e *Node) Branch(guard Guard, target *Node) *Node {
+	e.branches = append(e.branches, branch{guard: guard, target: target})
+	return e
+}
+
+/*
+	Adds a conditional transition like Branch does with a guard that sees the data the user has collected
+*/
+func (e *Node) AddBranchData(guard DataGuard, target *Node) *Node {
+	e.branches = append(e.branches, branch{dataGuard: guard, target: target})
+	return e
+}
+
+/*
+	Adds a conditional transition like Branch does with a guard that sees the number of the attempt,
+	e.g. to route to a hint node on the third wrong guess. The count is reset once the user reaches another node
+	or with Chain.ResetRetries
+*/
+func (e *Node) AddBranchAttempts(guard AttemptGuard, target *Node) *Node {
+	e.branches = append(e.branches, branch{attemptGuard: guard, target: target})
+	return e
+}
+
+/*
+	Adds a conditional transition like Branch does with a label describing it, e.g. for visualization
+*/
+func (e *Node) LabeledBranch(label string, guard Guard, target *Node) *Node {
+	e.branches = append(e.branches, branch{guard: guard, target: target, label: label})
+	return e
+}
+
+/*
+	Gets the conditional transitions of the node in the order they are checked
+	The else target and the next node are not included
+*/
+func (e *Node) Branches() []BranchEdge {
+	edges := make([]BranchEdge, len(e.branches))
+	for i, b := range e.branches {
+		edges[i] = BranchEdge{Target: b.target, Label: b.label}
+	}
+	return edges
+}
+
+/*
+	Sets a target node that is used when none of the branches matches
+	The precedence is: matching branch > else target > next node
+*/
+func (e *Node) Else(target *Node) *Node {
+	e.fallback = target
+	return e
+}
+
+/*
+	Makes users skip the node when the condition is met
+	A skipped node is passed right away as if it had no endpoint, following its branches,
+	else target or the next node for the message that has brought the user here
+*/
+func (e *Node) SkipIf(condition SkipCondition) *Node {
+	e.skipIf = condition
+	return e
+}
+
+/*
+	Checks if the node has declarative transitions configured
+*/
+func (e *Node) hasRoutes() bool {
+	return len(e.branches) > 0 || e.fallback != nil
+}
+
+/*
+	Points the links to other nodes at their copies
+*/
+func (e *Node) relink(copies map[*Node]*Node) {
+	if len(e.branches) > 0 {
+		branches := make([]branch, len(e.branches))
+		for i, b := range e.branches {
+			branches[i] = b
+			if target, ok := copies[b.target]; ok {
+				branches[i].target = target
+			}
+		}
+		e.branches = branches
+	}
+	if target, ok := copies[e.fallback]; ok {
+		e.fallback = target
+	}
+}
+
+/*
+	Predicts the node a user would be taken to by the message without advancing
+	Only the node configuration is considered (branches, else target, skipped nodes and the next node),
+	endpoint side effects are ignored. A node that rejects the input resolves to itself, the input is checked
+	the way Process does it: the minimal response delay, the date layouts and the validators
+*/
+func (e *Node) ResolveNext(m *tb.Message, recipient tb.Recipient) *Node {
+	if m == nil || !e.CheckEvent(m) || !e.flow.acceptable(recipient, e, m) {
+		return e
+	}
+	next, _ := e.flow.skip(e.route(m, recipient), m, recipient)
+	return next
+}
+
+/*
+	Picks the target of a matching branch, the else target or the next node
+*/
+func (e *Node) route(m *tb.Message, to tb.Recipient) *Node {
+	var data map[string]interface{}
+	for _, b := range e.branches {
+		if m == nil {
+			break
+		}
+		if b.dataGuard != nil {
+			if data == nil && to != nil {
+				// the snapshot is taken once for all the branches
+				data, _ = e.flow.GetAllData(to)
+			}
+			if b.dataGuard(m, data) {
+				return b.target
+			}
+			continue
+		}
+		if b.attemptGuard != nil {
+			attempts := 1
+			if to != nil {
+				attempts = e.flow.Attempts(to)
+			}
+			if b.attemptGuard(m, attempts) {
+				return b.target
+			}
+			continue
+		}
+		if b.guard(m) {
+			return b.target
+		}
+	}
+	if e.fallback != nil {
+		return e.fallback
+	}
+	return e.next
+}
+
+/*
+	Gets the value of the message that the node stores as the user answer
+	Stickers are stored by the file ID, dice rolls by the value
+*/
+func (e *Node) answerOf(m *tb.Message) (interface{}, bool) {
+	switch e.event {
+	case tb.OnSticker:
+		return m.Sticker.FileID, true
+	case tb.OnDice:
+		return m.Dice.Value, true
+	}
+	return nil, false
+}
+
 /*
 	Checks if the message type is matching the node type
 */
@@ -151,6 +737,46 @@ func (e *Node) CheckEvent(m *tb.Message) bool {
 		if m.Sticker == nil {
 			return false
 		}
+	case tb.OnDice:
+		if m.Dice == nil {
+			return false
+		}
+	case tb.OnQuery, tb.OnCallback:
+		// inline queries and callbacks are never delivered as messages
+		return false
 	}
 	return true
 }
+
+/*
+	Gets a copy of the media with a caption, the media is shared between users so it's not changed
+*/
+func withCaption(media tb.Sendable, caption string) tb.Sendable {
+	switch m := media.(type) {
+	case *tb.Photo:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	case *tb.Document:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	case *tb.Video:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	case *tb.Audio:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	case *tb.Animation:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	case *tb.Voice:
+		copied := *m
+		copied.Caption = caption
+		return &copied
+	}
+	return media
+}
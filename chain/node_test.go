@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+	"time"
+)
+
+func TestImmediateResponseIsRejected(t *testing.T) {
+	flow := newTestFlow(t, "date", "next")
+	user := &tb.User{ID: 1}
+	date, _ := flow.Search("date")
+	date.ExpectDate().MinResponseDelay(time.Hour)
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	result := flow.ProcessDetailed(textOf(user, "2024-05-01"))
+	if result.Outcome != Rejected {
+		t.Errorf("expected an immediate response rejected, got outcome %v", result.Outcome)
+	}
+	if id := positionOf(flow, user); id != "date" {
+		t.Errorf("expected the user to stay on date, got %q", id)
+	}
+	if _, ok := flow.GetData(user, "date"); ok {
+		t.Error("a rejected answer was stored")
+	}
+}
+
+func TestRejectedDateIsNotStored(t *testing.T) {
+	flow := newTestFlow(t, "date", "next")
+	user := &tb.User{ID: 1}
+	date, _ := flow.Search("date")
+	date.ExpectDate().AddValidator(func(m *tb.Message, data map[string]interface{}) error {
+		if m.Text < "2000" {
+			return errors.New("too old")
+		}
+		return nil
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "1999-12-31"))
+	if _, ok := flow.GetData(user, "date"); ok {
+		t.Error("a date rejected by the validator was stored")
+	}
+	flow.Process(textOf(user, "2024-05-01"))
+	answer, ok := flow.AnswerTime(user, "date")
+	if !ok || !answer.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the accepted date stored, got %v", answer)
+	}
+}
+
+func TestResolveNextAgreesWithProcess(t *testing.T) {
+	flow := newTestFlow(t, "first", "date", "second")
+	user := &tb.User{ID: 1}
+	first, _ := flow.Search("first")
+	first.SetValidator(func(m *tb.Message) error {
+		if m.Text == "bad" {
+			return errors.New("bad input")
+		}
+		return nil
+	})
+	date, _ := flow.Search("date")
+	date.ExpectDate()
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		text     string
+		expected string
+	}{
+		{"bad", "first"},
+		{"good", "date"},
+		{"not a date", "date"},
+		{"2024-05-01", "second"},
+	}
+	for _, step := range steps {
+		node, _ := flow.GetPosition(user)
+		predicted := node.ResolveNext(textOf(user, step.text), user)
+		flow.Process(textOf(user, step.text))
+		if predicted == nil || predicted.GetId() != step.expected || positionOf(flow, user) != step.expected {
+			t.Errorf("%q: predicted %v, processed to %q, expected %q", step.text, predicted, positionOf(flow, user), step.expected)
+		}
+	}
+	second, _ := flow.Search("second")
+	second.MinResponseDelay(time.Hour)
+	if next := second.ResolveNext(textOf(user, "fast"), user); next != second {
+		t.Errorf("an immediate response is predicted to advance to %v", next)
+	}
+}
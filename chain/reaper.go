@@ -0,0 +1,241 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"time"
+)
+
+/*
+	A recipient that is known only by its identificator
+*/
+type recipientId string
+
+func (r recipientId) Recipient() string {
+	return string(r)
+}
+
+/*
+	Sets for how long a user may be inactive before being removed from the flow
+	Zero disables the flow timeout
+*/
+func (c *Chain) SetTimeout(d time.Duration) *Chain {
+	c.mx.Lock()
+	c.timeout = d
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers when a user is removed from the flow due to the flow timeout
+*/
+func (c *Chain) OnTimeout(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onTimeout = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Sets a callback that triggers when a user is removed from the flow due to a node timeout
+*/
+func (c *Chain) OnNodeTimeout(callback UserCallback) *Chain {
+	c.mx.Lock()
+	c.onNodeTimeout = callback
+	c.unlock()
+	return c
+}
+
+/*
+	EvictReason tells why the flow has removed a user on its own
+*/
+type EvictReason int
+
+const (
+	EvictTTL      EvictReason = iota // the user has been inactive longer than the flow or the node timeout
+	EvictCapacity                    // the flow has been over the limit of sessions, see Chain.SetMaxSessions
+)
+
+/*
+	Sets a callback that triggers when the flow removes a user on its own, the reason tells the timeouts
+	from the limit of sessions. It fires after OnTimeout or OnNodeTimeout, an explicit cancel doesn't trigger it
+*/
+func (c *Chain) OnEvict(callback func(recipient string, reason EvictReason)) *Chain {
+	c.mx.Lock()
+	c.onEvict = callback
+	c.unlock()
+	return c
+}
+
+/*
+	Removes all the users that have been inactive for too long
+	When both the node and the flow timeouts apply, the shorter one wins
+	Returns the number of removed users
+*/
+func (c *Chain) Expire() int {
+	type expired struct {
+		to     tb.Recipient
+		node   *Node
+		byNode bool
+	}
+	var removed []expired
+	now := time.Now()
+	c.mx.RLock()
+	timeout, onTimeout, onNodeTimeout, onEvict := c.timeout, c.onTimeout, c.onNodeTimeout, c.onEvict
+	c.mx.RUnlock()
+	for _, sh := range c.getShards() {
+		sh.mx.Lock()
+		for key, s := range sh.sessions {
+			limit, byNode := timeout, false
+			if s.node != nil && s.node.timeout > 0 && (limit <= 0 || s.node.timeout <= limit) {
+				limit, byNode = s.node.timeout, true
+			}
+			if limit <= 0 || now.Sub(s.activity) < limit {
+				continue
+			}
+			sh.remove(key)
+			removed = append(removed, expired{to: recipientId(key), node: s.node, byNode: byNode})
+		}
+		sh.mx.Unlock()
+	}
+	for _, r := range removed {
+		if r.byNode && onNodeTimeout != nil {
+			onNodeTimeout(r.to, r.node)
+		} else if !r.byNode && onTimeout != nil {
+			onTimeout(r.to, r.node)
+		}
+		if onEvict != nil {
+			onEvict(r.to.Recipient(), EvictTTL)
+		}
+	}
+	return len(removed)
+}
+
+/*
+	Limits the number of users in the flow, zero means no limit which is the default
+	When a new user gets over the limit the least recently active user is removed,
+	the OnTimeout callback fires for the removed user
+*/
+func (c *Chain) SetMaxSessions(n int) *Chain {
+	c.mx.Lock()
+	c.maxSessions = n
+	c.unlock()
+	return c
+}
+
+/*
+	Removes the least recently active users while the flow is over the limit of sessions
+	The user that has just joined is never removed
+*/
+func (c *Chain) evictOver(joined string) {
+	c.mx.RLock()
+	limit, onTimeout, onEvict := c.maxSessions, c.onTimeout, c.onEvict
+	c.mx.RUnlock()
+	if limit <= 0 {
+		return
+	}
+	for {
+		total := 0
+		var oldest string
+		var oldestActivity time.Time
+		var from *shard
+		// every shard keeps its users in the order of activity, so only the last ones are compared
+		for _, sh := range c.getShards() {
+			sh.mx.RLock()
+			total += len(sh.sessions)
+			if key, found := sh.recency.oldest(joined); found {
+				if s, ok := sh.sessions[key]; ok && (from == nil || s.activity.Before(oldestActivity)) {
+					oldest, oldestActivity, from = key, s.activity, sh
+				}
+			}
+			sh.mx.RUnlock()
+		}
+		if total <= limit || from == nil {
+			return
+		}
+		from.mx.Lock()
+		s, ok := from.sessions[oldest]
+		if ok && s.activity.Equal(oldestActivity) {
+			from.remove(oldest)
+		} else {
+			// the user has been active in the meantime, look again
+			ok = false
+		}
+		from.mx.Unlock()
+		if ok && onTimeout != nil {
+			onTimeout(recipientId(oldest), s.node)
+		}
+		if ok && onEvict != nil {
+			onEvict(oldest, EvictCapacity)
+		}
+	}
+}
+
+/*
+	Starts a background reaper that removes inactive users every interval
+	Starting the reaper again replaces the previous one
+*/
+func (c *Chain) StartReaper(interval time.Duration) *Chain {
+	stop := make(chan struct{})
+	c.mx.Lock()
+	if c.closed {
+		c.unlock()
+		return c
+	}
+	if c.reaper != nil {
+		close(c.reaper)
+	}
+	c.reaper = stop
+	c.unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Expire()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+/*
+	Stops the background reaper if it's running
+*/
+func (c *Chain) StopReaper() *Chain {
+	c.mx.Lock()
+	if c.reaper != nil {
+		close(c.reaper)
+		c.reaper = nil
+	}
+	c.unlock()
+	return c
+}
+
+/*
+	Shuts the flow down stopping the background reaper
+	A closed flow doesn't start users and doesn't process updates anymore, Process calls return false.
+	It's safe to call more than once
+*/
+func (c *Chain) Close() error {
+	c.mx.Lock()
+	defer c.unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.reaper != nil {
+		close(c.reaper)
+		c.reaper = nil
+	}
+	return nil
+}
+
+/*
+	Checks if the flow has been closed
+*/
+func (c *Chain) isClosed() bool {
+	return c.settings().closed
+}
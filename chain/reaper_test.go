@@ -0,0 +1,43 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestMaxSessionsEvictsLeastRecentlyActive(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	flow.SetShards(16).SetMaxSessions(3)
+	var evicted []string
+	flow.OnEvict(func(recipient string, reason EvictReason) {
+		if reason == EvictCapacity {
+			evicted = append(evicted, recipient)
+		}
+	})
+	for i := 1; i <= 3; i++ {
+		if err := flow.Start(&tb.User{ID: i}, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first user is active again, so the second one is the least recently active
+	flow.Process(textOf(&tb.User{ID: 1}, "answer"))
+	flow.Start(&tb.User{ID: 4}, "hello")
+	if len(evicted) != 1 || evicted[0] != "2" {
+		t.Fatalf("expected the second user evicted, got %v", evicted)
+	}
+	// a user who has left isn't counted anymore
+	flow.Cancel(&tb.User{ID: 3})
+	flow.Start(&tb.User{ID: 5}, "hello")
+	if len(evicted) != 1 {
+		t.Errorf("a user was evicted below the limit, got %v", evicted)
+	}
+	flow.Start(&tb.User{ID: 6}, "hello")
+	if len(evicted) != 2 || evicted[1] != "1" {
+		t.Errorf("expected the first user evicted next, got %v", evicted)
+	}
+	for _, id := range []int{1, 2, 3} {
+		if flow.IsActive(&tb.User{ID: id}) {
+			t.Errorf("user %d is still in the flow", id)
+		}
+	}
+}
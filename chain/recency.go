@@ -0,0 +1,55 @@
+package chain
+
+import "container/list"
+
+/*
+	Keeps the users of a shard ordered by their last activity, the most recent one first
+	It's guarded by the mutex of the shard
+*/
+type recency struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+/*
+	Creates an empty order of users
+*/
+func newRecency() *recency {
+	return &recency{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+/*
+	Moves the user to the front as the most recently active one
+*/
+func (r *recency) touch(key string) {
+	if e, ok := r.elements[key]; ok {
+		r.order.MoveToFront(e)
+		return
+	}
+	r.elements[key] = r.order.PushFront(key)
+}
+
+/*
+	Removes the user from the order
+*/
+func (r *recency) forget(key string) {
+	if e, ok := r.elements[key]; ok {
+		r.order.Remove(e)
+		delete(r.elements, key)
+	}
+}
+
+/*
+	Gets the least recently active user except the specified one
+*/
+func (r *recency) oldest(except string) (string, bool) {
+	for e := r.order.Back(); e != nil; e = e.Prev() {
+		if key := e.Value.(string); key != except {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,248 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"sort"
+	"sync"
+)
+
+/*
+	Router dispatches incoming messages between several chain flows
+	Every flow keeps its own positions, so a user may be in several flows at once,
+	the precedence decides which of them gets a message first, see SetPrecedence
+*/
+type Router struct {
+	flows      []*Chain
+	unhandled  func(m *tb.Message)
+	interrupts bool
+	precedence Precedence
+	selector   func(m *tb.Message, active []*Chain) *Chain
+	mx         sync.RWMutex
+}
+
+/*
+	Precedence defines in which order the router offers a message to the flows
+*/
+type Precedence int
+
+const (
+	RegistrationOrder Precedence = iota // flows are tried in the order they were added, it's the default
+	LastActive                          // flows the user is in go first, the most recently active one first
+)
+
+/*
+	Creates a new router for the specified flows
+*/
+func NewRouter(flows ...*Chain) *Router {
+	return &Router{
+		flows:      flows,
+		interrupts: true,
+		mx:         sync.RWMutex{},
+	}
+}
+
+/*
+	Registers a flow in the router
+*/
+func (r *Router) Add(flow *Chain) *Router {
+	r.mx.Lock()
+	r.flows = append(r.flows, flow)
+	r.mx.Unlock()
+	return r
+}
+
+/*
+	Get all registered flows
+*/
+func (r *Router) GetFlows() []*Chain {
+	r.mx.RLock()
+	flows := make([]*Chain, len(r.flows))
+	copy(flows, r.flows)
+	r.mx.RUnlock()
+	return flows
+}
+
+/*
+	Sets the order in which the flows are offered a message, the registration order is used by default
+*/
+func (r *Router) SetPrecedence(precedence Precedence) *Router {
+	r.mx.Lock()
+	r.precedence = precedence
+	r.mx.Unlock()
+	return r
+}
+
+/*
+	Sets a function that routes a message explicitly, it picks one of the flows the user is in,
+	e.g. by the reply-to message. The picked flow goes first, the rest follow the precedence.
+	A nil result means there's no explicit choice
+*/
+func (r *Router) SetSelector(selector func(m *tb.Message, active []*Chain) *Chain) *Router {
+	r.mx.Lock()
+	r.selector = selector
+	r.mx.Unlock()
+	return r
+}
+
+/*
+	Orders the flows for the message according to the selector and the precedence
+*/
+func (r *Router) ordered(m *tb.Message) []*Chain {
+	flows := r.GetFlows()
+	r.mx.RLock()
+	precedence, selector := r.precedence, r.selector
+	r.mx.RUnlock()
+	if precedence == RegistrationOrder && selector == nil {
+		return flows
+	}
+	var active, inactive []*Chain
+	activity := make(map[*Chain]int64)
+	for _, flow := range flows {
+		if last, ok := flow.LastActivity(flow.keyOf(m)); ok && flow.IsActive(flow.keyOf(m)) {
+			active = append(active, flow)
+			activity[flow] = last.UnixNano()
+		} else {
+			inactive = append(inactive, flow)
+		}
+	}
+	if precedence == LastActive {
+		sort.SliceStable(active, func(i, j int) bool {
+			return activity[active[i]] > activity[active[j]]
+		})
+		flows = append(active, inactive...)
+	}
+	var picked *Chain
+	if selector != nil {
+		picked = selector(m, active)
+	}
+	if _, ok := activity[picked]; !ok {
+		return flows
+	}
+	// the picked flow goes first, the rest keep their order
+	ordered := []*Chain{picked}
+	for _, flow := range flows {
+		if flow != picked {
+			ordered = append(ordered, flow)
+		}
+	}
+	return ordered
+}
+
+/*
+	Sets a handler for messages that none of the flows has processed
+*/
+func (r *Router) SetUnhandled(handler func(m *tb.Message)) *Router {
+	r.mx.Lock()
+	r.unhandled = handler
+	r.mx.Unlock()
+	return r
+}
+
+/*
+	Passes the message to the registered flows in order
+	Returns true once one of the flows has claimed the message, even if the input was rejected,
+	otherwise the unhandled handler is called. The order depends on the precedence and the selector.
+	A trigger command of a flow starts that flow before the message reaches any other flow,
+	so triggers take precedence over transparent commands, see SetTriggersInterrupt
+*/
+func (r *Router) Process(m *tb.Message) bool {
+	if m == nil {
+		return false
+	}
+	if r.processTrigger(m) {
+		return true
+	}
+	for _, flow := range r.ordered(m) {
+		if flow.ProcessDetailed(m).Claimed() {
+			return true
+		}
+	}
+	r.mx.RLock()
+	unhandled := r.unhandled
+	r.mx.RUnlock()
+	if unhandled != nil {
+		unhandled(m)
+	}
+	return false
+}
+
+/*
+	Cancels the user in every registered flow
+	Returns identificators of the flows that actually had the user
+*/
+func (r *Router) CancelAll(of tb.Recipient) []string {
+	var cancelled []string
+	for _, flow := range r.GetFlows() {
+		if flow.Cancel(of) {
+			cancelled = append(cancelled, flow.GetId())
+		}
+	}
+	return cancelled
+}
+
+/*
+	Sets if a trigger command starts its flow for a user who is in another flow, true by default
+	The user is cancelled in the other flows first. When it's disabled such a command is processed
+	by the flow the user is in like any other message
+*/
+func (r *Router) SetTriggersInterrupt(enabled bool) *Router {
+	r.mx.Lock()
+	r.interrupts = enabled
+	r.mx.Unlock()
+	return r
+}
+
+/*
+	Registers the router as the bot handler of the trigger commands of all the flows, see Chain.SetTrigger
+*/
+func (r *Router) HandleTriggers(bot *tb.Bot) *Router {
+	for _, flow := range r.GetFlows() {
+		if trigger := flow.GetTrigger(); trigger != "" {
+			bot.Handle(trigger, func(m *tb.Message) {
+				r.Process(m)
+			})
+		}
+	}
+	return r
+}
+
+/*
+	Starts the flow the message is a trigger command of
+	The restart policy of the flow applies when the user is in that flow already.
+	The user is cancelled in the other flows only once the start has succeeded.
+	Returns true if the message was taken as a trigger and the flow has started
+*/
+func (r *Router) processTrigger(m *tb.Message) bool {
+	flows := r.GetFlows()
+	var triggered *Chain
+	for _, flow := range flows {
+		if flow.isTrigger(m) {
+			triggered = flow
+			break
+		}
+	}
+	if triggered == nil {
+		return false
+	}
+	r.mx.RLock()
+	interrupts := r.interrupts
+	r.mx.RUnlock()
+	var interrupted []*Chain
+	for _, flow := range flows {
+		if flow == triggered || !flow.IsActive(flow.keyOf(m)) {
+			continue
+		}
+		if !interrupts {
+			return false
+		}
+		interrupted = append(interrupted, flow)
+	}
+	if err := triggered.startTriggered(triggered.keyOf(m)); err != nil {
+		// the user stays where they were
+		return false
+	}
+	for _, flow := range interrupted {
+		flow.Cancel(flow.keyOf(m))
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestTriggerCancelsOtherFlowsOnlyOnStart(t *testing.T) {
+	survey := newTestFlow(t, "question")
+	signup := newTestFlow(t, "name", "email")
+	signup.SetTrigger("/signup")
+	router := NewRouter(survey, signup)
+	user := &tb.User{ID: 1}
+	if err := survey.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := signup.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	signup.SetRestartPolicy(Ignore)
+	if router.processTrigger(textOf(user, "/signup")) {
+		t.Error("a trigger was reported as handled while its flow didn't start")
+	}
+	if !survey.IsActive(user) {
+		t.Error("the user was cancelled in the other flow although the start failed")
+	}
+	signup.SetRestartPolicy(Overwrite)
+	if !router.processTrigger(textOf(user, "/signup")) {
+		t.Error("a trigger was not handled")
+	}
+	if survey.IsActive(user) {
+		t.Error("the user was not cancelled in the other flow")
+	}
+	if id := positionOf(signup, user); id != "name" {
+		t.Errorf("expected the user on name, got %q", id)
+	}
+}
@@ -0,0 +1,391 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"time"
+)
+
+/*
+	A session holds everything the flow knows about a particular user
+	Sessions are guarded by the mutex of their shard, so the position and the data are always consistent
+*/
+type session struct {
+	node     *Node
+	data     map[string]interface{}
+	activity time.Time
+	arrived  time.Time
+	attempts int
+	stuck    bool
+	prompt   *tb.Message
+	busy     bool
+	queue    []*tb.Message
+	paused   time.Time
+	history  []string
+	location *time.Location
+}
+
+/*
+	Creates a new session at a specified node
+	The visited nodes are recorded only if it's asked to track the history
+*/
+func newSession(node *Node, trackHistory bool) *session {
+	now := time.Now()
+	s := &session{
+		node:     node,
+		data:     make(map[string]interface{}),
+		activity: now,
+		arrived:  now,
+	}
+	if trackHistory {
+		s.history = []string{}
+		if node != nil {
+			s.history = append(s.history, node.id)
+		}
+	}
+	return s
+}
+
+/*
+	Moves the session to a node resetting the per-node counters
+*/
+func (s *session) arrive(node *Node) {
+	if s.history != nil && node != nil {
+		s.history = append(s.history, node.id)
+	}
+	s.node = node
+	s.arrived = time.Now()
+	s.attempts = 0
+	s.stuck = false
+}
+
+/*
+	Remembers the last prompt message sent to the user
+*/
+func (c *Chain) setPromptMessage(of tb.Recipient, msg *tb.Message) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	if s, ok := sh.sessions[of.Recipient()]; ok && msg != nil {
+		s.prompt = msg
+	}
+	sh.mx.Unlock()
+}
+
+/*
+	Gets the last prompt message sent to the user
+*/
+func (c *Chain) getPromptMessage(of tb.Recipient) (*tb.Message, error) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return nil, ErrUserNotInFlow
+	}
+	if s.prompt == nil {
+		return nil, ErrNoPromptMessage
+	}
+	return s.prompt, nil
+}
+
+/*
+	Deletes the last prompt message sent to the user if there's one, errors are ignored
+*/
+func (c *Chain) deletePromptMessage(bot *tb.Bot, of tb.Recipient) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	var msg *tb.Message
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		msg, s.prompt = s.prompt, nil
+	}
+	sh.mx.Unlock()
+	if msg != nil && !c.intercept(OutgoingMessage{Action: ActionDelete, Recipient: of.Recipient(), What: msg}) {
+		bot.Delete(msg)
+	}
+}
+
+/*
+	Marks the user as active right now
+*/
+func (c *Chain) touch(of tb.Recipient) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		sh.touch(of.Recipient(), s)
+	}
+	sh.mx.Unlock()
+}
+
+/*
+	Checks if the user is in the flow
+	A user who has just reached the end of the flow is not considered active anymore.
+	A paused user still has a position, so the user is active unless it's asked to exclude paused users,
+	e.g. IsActive(of, true), see IsPaused
+*/
+func (c *Chain) IsActive(of tb.Recipient, excludePaused ...bool) bool {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok || s.node == nil {
+		return false
+	}
+	return len(excludePaused) == 0 || !excludePaused[0] || !time.Now().Before(s.paused)
+}
+
+/*
+	Pauses processing of the messages of the user for a duration, e.g. for a cooldown
+	The user resumes automatically once the duration is over, a zero or negative duration resumes right away.
+	While paused, Process returns false and the pause message is sent if it's set, see Chain.SetPauseMessage.
+	Callbacks and inline queries are ignored as well, a callback is answered with the pause message as a notification
+*/
+func (c *Chain) PauseFor(of tb.Recipient, d time.Duration) bool {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return false
+	}
+	s.paused = time.Now().Add(d)
+	return true
+}
+
+/*
+	Checks if the processing of the user messages is paused
+*/
+func (c *Chain) IsPaused(of tb.Recipient) bool {
+	_, paused := c.pausedUntil(of)
+	return paused
+}
+
+/*
+	Gets when the pause of the user is over
+*/
+func (c *Chain) pausedUntil(of tb.Recipient) (time.Time, bool) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok || !time.Now().Before(s.paused) {
+		return time.Time{}, false
+	}
+	return s.paused, true
+}
+
+/*
+	Gets when the user has reached the current node
+*/
+func (c *Chain) arrivedAt(of tb.Recipient) time.Time {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		return s.arrived
+	}
+	return time.Time{}
+}
+
+/*
+	Gets the time of the last user activity in the flow
+*/
+func (c *Chain) LastActivity(of tb.Recipient) (time.Time, bool) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.activity, true
+}
+
+/*
+	Gets for how long each user in the flow has been idle by recipient
+*/
+func (c *Chain) IdleDurations() map[string]time.Duration {
+	now := time.Now()
+	idle := make(map[string]time.Duration)
+	for _, sh := range c.getShards() {
+		sh.mx.RLock()
+		for recipient, s := range sh.sessions {
+			idle[recipient] = now.Sub(s.activity)
+		}
+		sh.mx.RUnlock()
+	}
+	return idle
+}
+
+/*
+	Puts the user on a specified node with a clean session
+*/
+func (c *Chain) resetPosition(of tb.Recipient, node *Node) {
+	track := c.tracksHistory()
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	_, existed := sh.sessions[of.Recipient()]
+	sh.put(of.Recipient(), newSession(node, track))
+	sh.mx.Unlock()
+	c.totals.addReached(node)
+	if !existed {
+		c.evictOver(of.Recipient())
+	}
+}
+
+/*
+	Retrieves a value stored for the user by key
+*/
+func (c *Chain) GetData(of tb.Recipient, key string) (interface{}, bool) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return nil, false
+	}
+	value, ok := s.data[key]
+	return value, ok
+}
+
+/*
+	Stores a value for the user by key
+	Returns false if the user is not in the flow
+*/
+func (c *Chain) SetData(of tb.Recipient, key string, value interface{}) bool {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return false
+	}
+	s.data[key] = value
+	return true
+}
+
+/*
+	Appends a message to the collected ones by key
+*/
+func (c *Chain) appendCollected(of tb.Recipient, key string, m *tb.Message) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.Lock()
+	if s, ok := sh.sessions[of.Recipient()]; ok {
+		collected, _ := s.data[key].([]*tb.Message)
+		s.data[key] = append(collected, m)
+	}
+	sh.mx.Unlock()
+}
+
+/*
+	Retrieves the messages collected for the user by key, see Node.Collect
+*/
+func (c *Chain) Collected(of tb.Recipient, key string) []*tb.Message {
+	value, _ := c.GetData(of, key)
+	collected, _ := value.([]*tb.Message)
+	result := make([]*tb.Message, len(collected))
+	copy(result, collected)
+	return result
+}
+
+/*
+	Retrieves a copy of all the values stored for the user
+*/
+func (c *Chain) GetAllData(of tb.Recipient) (map[string]interface{}, bool) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return nil, false
+	}
+	data := make(map[string]interface{}, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	return data, true
+}
+
+/*
+	Retrieves an answer stored for a node as a string
+	Returns false if there's no answer or it's of a different type
+*/
+func (c *Chain) AnswerString(of tb.Recipient, nodeId string) (string, bool) {
+	value, _ := c.GetData(of, nodeId)
+	answer, ok := value.(string)
+	return answer, ok
+}
+
+/*
+	Retrieves an answer stored for a node as an integer
+	Returns false if there's no answer or it's of a different type
+*/
+func (c *Chain) AnswerInt(of tb.Recipient, nodeId string) (int, bool) {
+	value, _ := c.GetData(of, nodeId)
+	answer, ok := value.(int)
+	return answer, ok
+}
+
+/*
+	Retrieves an answer stored for a node as a float
+	Returns false if there's no answer or it's of a different type
+*/
+func (c *Chain) AnswerFloat(of tb.Recipient, nodeId string) (float64, bool) {
+	value, _ := c.GetData(of, nodeId)
+	answer, ok := value.(float64)
+	return answer, ok
+}
+
+/*
+	A snapshot of everything the flow knows about a user
+	PausedUntil is when the last pause of the user is over, it may be used to restore the pause with PauseFor.
+	Attempts is the number of the current attempt on the node like Chain.Attempts tells, Timezone is the one
+	set with Chain.SetUserTimezone or UTC, History holds the visited node IDs and is nil unless the flow tracks it
+*/
+type UserState struct {
+	NodeId       string
+	Step         int
+	Data         map[string]interface{}
+	LastActivity time.Time
+	PausedUntil  time.Time
+	Attempts     int
+	Timezone     *time.Location
+	History      []string
+}
+
+/*
+	Gets a snapshot of the user state in the flow
+	The snapshot is a copy, changing it does not affect the flow
+*/
+func (c *Chain) UserState(of tb.Recipient) (UserState, bool) {
+	sh := c.shardOf(of.Recipient())
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	s, ok := sh.sessions[of.Recipient()]
+	if !ok {
+		return UserState{}, false
+	}
+	state := UserState{
+		Data:         make(map[string]interface{}, len(s.data)),
+		LastActivity: s.activity,
+		PausedUntil:  s.paused,
+		Attempts:     s.attempts + 1,
+		Timezone:     time.UTC,
+	}
+	if s.location != nil {
+		state.Timezone = s.location
+	}
+	if s.history != nil {
+		state.History = make([]string, len(s.history))
+		copy(state.History, s.history)
+	}
+	if s.node != nil {
+		state.NodeId = s.node.id
+		// the step is a distance from the root of the chain
+		for node := s.node; node.prev != nil; node = node.prev {
+			state.Step++
+		}
+	}
+	for key, value := range s.data {
+		state.Data[key] = value
+	}
+	return state, true
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCancelAndDataRead(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			flow.Enter(user)
+			flow.SetData(user, "name", "Alice")
+			flow.Cancel(user)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			state, ok := flow.UserState(user)
+			if !ok {
+				continue
+			}
+			// the data can only be seen along with the position it belongs to
+			if _, named := state.Data["name"]; named && state.NodeId != "first" {
+				t.Errorf("torn read, the data %v is seen on node %q", state.Data, state.NodeId)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if _, ok := flow.GetPosition(user); ok {
+		t.Error("the position is kept after the cancel")
+	}
+	if _, ok := flow.GetData(user, "name"); ok {
+		t.Error("the data is kept after the cancel")
+	}
+}
+
+func TestDeletePositionClearsUserState(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	flow.SetTrackHistory(true)
+	user := &tb.User{ID: 1}
+	first, _ := flow.Search("first")
+	first.SetValidator(func(m *tb.Message) error {
+		return errors.New("try again")
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.SetData(user, "name", "Alice")
+	flow.Process(textOf(user, "answer"))
+	flow.PauseFor(user, time.Hour)
+	flow.SetUserTimezone(user, time.FixedZone("UTC+3", 3*60*60))
+	flow.appendCollected(user, "photos", textOf(user, "photo"))
+	if flow.Attempts(user) != 2 {
+		t.Fatalf("expected a failed attempt to be counted, got attempt %d", flow.Attempts(user))
+	}
+	flow.DeletePosition(user)
+	if _, ok := flow.UserState(user); ok {
+		t.Error("the user state is kept")
+	}
+	if _, err := flow.getPromptMessage(user); err != ErrUserNotInFlow {
+		t.Errorf("the last prompt is kept, got %v", err)
+	}
+	if flow.IsPaused(user) {
+		t.Error("the pause is kept")
+	}
+	if flow.UserTimezone(user) != time.UTC {
+		t.Error("the timezone is kept")
+	}
+	if len(flow.Collected(user, "photos")) != 0 {
+		t.Error("the collected messages are kept")
+	}
+	if flow.Attempts(user) != 0 {
+		t.Error("the attempts are kept")
+	}
+	for _, sh := range flow.getShards() {
+		if len(sh.sessions) != 0 || len(sh.starting) != 0 {
+			t.Errorf("a shard still holds %d sessions and %d starts", len(sh.sessions), len(sh.starting))
+		}
+	}
+}
+
+func TestUserStateSnapshot(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	flow.SetTrackHistory(true)
+	user := &tb.User{ID: 1}
+	second, _ := flow.Search("second")
+	second.SetValidator(func(m *tb.Message) error {
+		return errors.New("try again")
+	})
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.Process(textOf(user, "answer"))
+	flow.Process(textOf(user, "wrong"))
+	zone := time.FixedZone("UTC+3", 3*60*60)
+	flow.SetUserTimezone(user, zone)
+	state, ok := flow.UserState(user)
+	if !ok {
+		t.Fatal("the user is not in the flow")
+	}
+	if state.NodeId != "second" || state.Attempts != 2 || state.Timezone != zone {
+		t.Errorf("unexpected snapshot %+v", state)
+	}
+	if len(state.History) != 2 || state.History[0] != "first" || state.History[1] != "second" {
+		t.Errorf("unexpected history %v", state.History)
+	}
+}
+
+func TestPausedUserIsActiveUnlessExcluded(t *testing.T) {
+	flow := newTestFlow(t, "first")
+	user := &tb.User{ID: 1}
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.PauseFor(user, time.Hour)
+	if !flow.IsActive(user) || !flow.IsActive(user, false) {
+		t.Error("a paused user is not active")
+	}
+	if flow.IsActive(user, true) {
+		t.Error("a paused user is active although paused users are excluded")
+	}
+	flow.PauseFor(user, 0)
+	if !flow.IsActive(user, true) {
+		t.Error("a resumed user is not active")
+	}
+}
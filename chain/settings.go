@@ -0,0 +1,149 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"time"
+)
+
+/*
+	A snapshot of the flow settings that updates are processed with
+	It's published on every change made under the flow lock, so processing an update loads it once
+	instead of taking the flow lock for every setting. A snapshot is never modified once published
+*/
+type settings struct {
+	shards         []*shard
+	bot            *tb.Bot
+	closed         bool
+	chatTypes      map[tb.ChatType]bool
+	updateFilter   Guard
+	keyFunc        func(m *tb.Message) string
+	callbackKey    func(cb *tb.Callback) string
+	inFlight       InFlightPolicy
+	passthrough    Guard
+	transparent    map[string]bool
+	helpTriggers   map[string]bool
+	defaultHelp    string
+	pauseMessage   func(recipient tb.Recipient, until time.Time) string
+	precondition   func(recipient tb.Recipient, m *tb.Message) (bool, string)
+	onMissingNode  func(recipient tb.Recipient) *Node
+	onDuration     func(flowId, nodeId string, d time.Duration)
+	invalidInput   TextFunc
+	maxTransitions int
+	onLoopDetected UserCallback
+	autoPrompt     bool
+	onAdvance      AdvanceCallback
+	deletePrevious bool
+	stuckAttempts  int
+	onStuck        StuckCallback
+	trackHistory   bool
+	onPosition     PositionCallback
+	defaultOptions *tb.SendOptions
+	transformer    func(recipient tb.Recipient, node *Node, text string) string
+	outgoing       func(msg OutgoingMessage)
+	dryRun         bool
+	onSuppressed   func(msg OutgoingMessage)
+	nodes          map[*Node]nodeSettings
+}
+
+/*
+	The settings of a node that may be replaced while the flow is processing updates
+*/
+type nodeSettings struct {
+	prompt        *message
+	endpoint      Callback
+	validator     Validator
+	dataValidator DataValidator
+	validators    []namedValidator
+}
+
+/*
+	Publishes the current settings of the flow, the flow mutex must be held
+*/
+func (c *Chain) publish() {
+	nodes := make(map[*Node]nodeSettings)
+	for node := c.root; node != nil; node = node.next {
+		nodes[node] = node.settings()
+	}
+	nodes[c.end] = c.end.settings()
+	c.current.Store(&settings{
+		shards:         c.shards,
+		bot:            c.bot,
+		closed:         c.closed,
+		chatTypes:      c.chatTypes,
+		updateFilter:   c.updateFilter,
+		keyFunc:        c.keyFunc,
+		callbackKey:    c.callbackKey,
+		inFlight:       c.inFlight,
+		passthrough:    c.passthrough,
+		transparent:    c.transparent,
+		helpTriggers:   c.helpTriggers,
+		defaultHelp:    c.defaultHelp,
+		pauseMessage:   c.pauseMessage,
+		precondition:   c.precondition,
+		onMissingNode:  c.onMissingNode,
+		onDuration:     c.onDuration,
+		invalidInput:   c.invalidInput,
+		maxTransitions: c.maxTransitions,
+		onLoopDetected: c.onLoopDetected,
+		autoPrompt:     c.autoPrompt,
+		onAdvance:      c.onAdvance,
+		deletePrevious: c.deletePrevious,
+		stuckAttempts:  c.stuckAttempts,
+		onStuck:        c.onStuck,
+		trackHistory:   c.trackHistory,
+		onPosition:     c.onPosition,
+		defaultOptions: c.defaultOptions,
+		transformer:    c.transformer,
+		outgoing:       c.outgoing,
+		dryRun:         c.dryRun,
+		onSuppressed:   c.onSuppressed,
+		nodes:          nodes,
+	})
+}
+
+/*
+	Publishes the settings and releases the flow mutex, every change of the settings goes through here
+*/
+func (c *Chain) unlock() {
+	c.publish()
+	c.mx.Unlock()
+}
+
+/*
+	Gets the last published settings of the flow without taking the flow lock
+*/
+func (c *Chain) settings() *settings {
+	return c.current.Load().(*settings)
+}
+
+/*
+	Gets the replaceable settings of a node without taking the flow lock
+	A node linked to the chain after the settings were published makes them published again
+*/
+func (c *Chain) nodeSettings(node *Node) nodeSettings {
+	if ns, ok := c.settings().nodes[node]; ok {
+		return ns
+	}
+	c.mx.Lock()
+	c.publish()
+	ns, ok := c.settings().nodes[node]
+	if !ok {
+		// the node is not a part of the chain
+		ns = node.settings()
+	}
+	c.mx.Unlock()
+	return ns
+}
+
+/*
+	Copies the replaceable settings of the node, the flow mutex must be held
+*/
+func (e *Node) settings() nodeSettings {
+	return nodeSettings{
+		prompt:        e.prompt,
+		endpoint:      e.endpoint,
+		validator:     e.validator,
+		dataValidator: e.dataValidator,
+		validators:    e.validators,
+	}
+}
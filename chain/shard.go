@@ -0,0 +1,123 @@
+package chain
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	A shard is a part of the user sessions with its own lock
+	Splitting the sessions lets users in different shards be processed without waiting for each other
+*/
+type shard struct {
+	sessions map[string]*session
+	starting map[string]chan struct{}
+	recency  *recency
+	mx       sync.RWMutex
+}
+
+/*
+	Creates a specified number of empty shards
+*/
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{
+			sessions: make(map[string]*session),
+			starting: make(map[string]chan struct{}),
+			recency:  newRecency(),
+			mx:       sync.RWMutex{},
+		}
+	}
+	return shards
+}
+
+/*
+	Stores a new session of the user as the most recently active one, the shard mutex must be held
+*/
+func (sh *shard) put(key string, s *session) {
+	sh.sessions[key] = s
+	sh.recency.touch(key)
+}
+
+/*
+	Marks the user as active right now, the shard mutex must be held
+*/
+func (sh *shard) touch(key string, s *session) {
+	s.activity = time.Now()
+	sh.recency.touch(key)
+}
+
+/*
+	Removes the session of the user with every piece of per-user state
+	Every way of leaving the flow goes through here, the shard mutex must be held
+*/
+func (sh *shard) remove(key string) (*session, bool) {
+	s, ok := sh.sessions[key]
+	if ok {
+		delete(sh.sessions, key)
+		sh.recency.forget(key)
+	}
+	return s, ok
+}
+
+/*
+	Splits the user sessions into a specified number of shards, a single shard is used by default
+	Existing sessions are moved to the new shards, however it's meant to be called before serving users
+*/
+func (c *Chain) SetShards(n int) *Chain {
+	if n < 1 {
+		n = 1
+	}
+	shards := newShards(n)
+	c.mx.Lock()
+	var moved []string
+	all := make(map[string]*session)
+	for _, sh := range c.shards {
+		sh.mx.Lock()
+		for key, s := range sh.sessions {
+			moved = append(moved, key)
+			all[key] = s
+		}
+		sh.mx.Unlock()
+	}
+	// the users are put from the least recently active one to keep their order in the new shards
+	sort.Slice(moved, func(i, j int) bool {
+		return all[moved[i]].activity.Before(all[moved[j]].activity)
+	})
+	for _, key := range moved {
+		shards[shardIndex(key, n)].put(key, all[key])
+	}
+	c.shards = shards
+	c.unlock()
+	return c
+}
+
+/*
+	Gets all the shards
+*/
+func (c *Chain) getShards() []*shard {
+	return c.settings().shards
+}
+
+/*
+	Gets the shard that holds the session of a recipient
+*/
+func (c *Chain) shardOf(key string) *shard {
+	shards := c.getShards()
+	return shards[shardIndex(key, len(shards))]
+}
+
+/*
+	Picks a shard for a recipient
+*/
+func shardIndex(key string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,46 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+	Processes messages of many users concurrently, each user stays on a single node,
+	so every message takes the lock of its shard for writing
+*/
+func benchmarkShards(b *testing.B, shards int) {
+	flow, err := NewChainFlow("bench", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	flow.SetDryRun(true).SetShards(shards)
+	flow.GetRoot().Then("loop", func(e *Node, m *tb.Message) *Node {
+		return e
+	}, tb.OnText)
+	const users = 10000
+	messages := make([]*tb.Message, users)
+	for i := range messages {
+		messages[i] = textOf(&tb.User{ID: i + 1}, "answer")
+		if err := flow.Enter(messages[i].Sender); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			flow.Process(messages[atomic.AddInt64(&next, 1)%users])
+		}
+	})
+}
+
+func BenchmarkProcess(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			benchmarkShards(b, shards)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package chain
+
+import (
+	"errors"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestFailedStartAutoKeepsState(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	// the sender is the only way to the bot, so nothing is sent for real
+	flow.SetDryRun(false)
+	user := &tb.User{ID: 1}
+	failure := errors.New("send failed")
+	first, _ := flow.Search("first")
+	first.SetPrompt("first?").SetSender(func(ctx SendContext) (*tb.Message, error) {
+		return nil, failure
+	})
+	if err := flow.Enter(user); err != nil {
+		t.Fatal(err)
+	}
+	flow.SetData(user, "name", "Alice")
+	reached := flow.Funnel()["first"]
+	if err := flow.StartAuto(user); err != failure {
+		t.Fatalf("expected the send error, got %v", err)
+	}
+	if name, _ := flow.AnswerString(user, "name"); name != "Alice" {
+		t.Errorf("expected the data kept after a failed start, got %q", name)
+	}
+	if n := flow.Funnel()["first"]; n != reached {
+		t.Errorf("a failed start was counted in the funnel, %d instead of %d", n, reached)
+	}
+}
+
+func TestSecondStartGivesCleanSlate(t *testing.T) {
+	flow := newTestFlow(t, "first", "second")
+	user := &tb.User{ID: 1}
+	if err := flow.Start(user, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	flow.SetData(user, "name", "Alice")
+	flow.Process(textOf(user, "answer"))
+	if err := flow.Start(user, "again"); err != nil {
+		t.Fatal(err)
+	}
+	if id := positionOf(flow, user); id != "first" {
+		t.Errorf("expected the user on first, got %q", id)
+	}
+	if data, _ := flow.GetAllData(user); len(data) != 0 {
+		t.Errorf("expected no data after the second start, got %v", data)
+	}
+	if err := flow.StartKeepingState(user, "again"); err != nil {
+		t.Fatal(err)
+	}
+	flow.SetData(user, "name", "Alice")
+	if err := flow.StartKeepingState(user, "again"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := flow.AnswerString(user, "name"); name != "Alice" {
+		t.Errorf("expected the data kept by StartKeepingState, got %q", name)
+	}
+}
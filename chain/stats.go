@@ -0,0 +1,179 @@
+package chain
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	An at-a-glance snapshot of the flow
+	Active is the number of users in the flow right now, PerNode holds the number of users by node ID
+	and PerStep by step name (see Node.SetStepName), the totals are counted since the flow was created
+*/
+type FlowStats struct {
+	Active    int
+	PerNode   map[string]int
+	PerStep   map[string]int
+	Started   int
+	Completed int
+	Cancelled int
+}
+
+/*
+	Totals of the flow lifecycle events
+*/
+type counters struct {
+	started   int
+	completed int
+	cancelled int
+	reached   map[string]int
+	mx        sync.Mutex
+}
+
+/*
+	Counts a user that has reached a node
+*/
+func (t *counters) addReached(node *Node) {
+	if node == nil {
+		return
+	}
+	t.mx.Lock()
+	if t.reached == nil {
+		t.reached = make(map[string]int)
+	}
+	t.reached[node.id]++
+	t.mx.Unlock()
+}
+
+/*
+	Counts the users that have started the flow
+*/
+func (t *counters) addStarted(n int) {
+	t.mx.Lock()
+	t.started += n
+	t.mx.Unlock()
+}
+
+/*
+	Counts the users that have completed the flow
+*/
+func (t *counters) addCompleted(n int) {
+	t.mx.Lock()
+	t.completed += n
+	t.mx.Unlock()
+}
+
+/*
+	Counts the users that have been cancelled
+*/
+func (t *counters) addCancelled(n int) {
+	t.mx.Lock()
+	t.cancelled += n
+	t.mx.Unlock()
+}
+
+/*
+	Gets a snapshot of the flow statistics
+	All the shards are locked at once, so the snapshot is consistent
+*/
+func (c *Chain) Stats() FlowStats {
+	shards := c.getShards()
+	for _, sh := range shards {
+		sh.mx.RLock()
+	}
+	stats := FlowStats{PerNode: make(map[string]int), PerStep: make(map[string]int)}
+	for _, sh := range shards {
+		for _, s := range sh.sessions {
+			if s.node == nil {
+				// the user has just finished the flow
+				continue
+			}
+			stats.Active++
+			stats.PerNode[s.node.id]++
+			stats.PerStep[s.node.GetStepName()]++
+		}
+	}
+	c.totals.mx.Lock()
+	stats.Started = c.totals.started
+	stats.Completed = c.totals.completed
+	stats.Cancelled = c.totals.cancelled
+	c.totals.mx.Unlock()
+	for _, sh := range shards {
+		sh.mx.RUnlock()
+	}
+	return stats
+}
+
+/*
+	Counts the users that are on a node with ID right now
+*/
+func (c *Chain) CountAt(nodeId string) int {
+	count := 0
+	for _, sh := range c.getShards() {
+		sh.mx.RLock()
+		for _, s := range sh.sessions {
+			if s.node != nil && s.node.id == nodeId {
+				count++
+			}
+		}
+		sh.mx.RUnlock()
+	}
+	return count
+}
+
+/*
+	Gets the recipients of the users that are on a node with ID right now, e.g. to send them a reminder
+	The slice is empty for unknown or unoccupied nodes
+*/
+func (c *Chain) RecipientsAt(nodeId string) []string {
+	recipients := []string{}
+	for _, sh := range c.getShards() {
+		sh.mx.RLock()
+		for key, s := range sh.sessions {
+			if s.node != nil && s.node.id == nodeId {
+				recipients = append(recipients, key)
+			}
+		}
+		sh.mx.RUnlock()
+	}
+	return recipients
+}
+
+/*
+	Gets the recipients whose stored node doesn't belong to the chain anymore, e.g. after a manual edit of the positions
+	A user stored on End is reported as well since processing treats such a user as lost and recovers them.
+	It only reads the positions, the users may be repaired with SetPosition or cancelled.
+	It complements Validate checking the runtime state instead of the structure
+*/
+func (c *Chain) VerifyPositions() []string {
+	reachable := make(map[*Node]bool)
+	for n := c.root.next; n != nil; n = n.next {
+		reachable[n] = true
+	}
+	broken := []string{}
+	for _, sh := range c.getShards() {
+		sh.mx.RLock()
+		for key, s := range sh.sessions {
+			if s.node != nil && !reachable[s.node] {
+				broken = append(broken, key)
+			}
+		}
+		sh.mx.RUnlock()
+	}
+	sort.Strings(broken)
+	return broken
+}
+
+/*
+	Gets how many times users have reached each node by node ID since the flow was created
+	Unlike CountAt it counts every user that has passed through a node, so it shows where users drop off
+*/
+func (c *Chain) Funnel() map[string]int {
+	c.totals.mx.Lock()
+	defer c.totals.mx.Unlock()
+	funnel := make(map[string]int, len(c.totals.reached))
+	for nodeId, count := range c.totals.reached {
+		funnel[nodeId] = count
+	}
+	return funnel
+}
@@ -0,0 +1,24 @@
+package chain
+
+import (
+	tb "gopkg.in/tucnak/telebot.v2"
+	"testing"
+)
+
+func TestVerifyPositionsReportsUsersOnEnd(t *testing.T) {
+	flow := newTestFlow(t, "first")
+	onNode, onEnd := &tb.User{ID: 1}, &tb.User{ID: 2}
+	for _, user := range []*tb.User{onNode, onEnd} {
+		if err := flow.Start(user, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flow.SetPosition(onEnd, flow.End())
+	if flow.contains(flow.End()) {
+		t.Fatal("processing doesn't treat End as a missing node anymore")
+	}
+	broken := flow.VerifyPositions()
+	if len(broken) != 1 || broken[0] != onEnd.Recipient() {
+		t.Errorf("broken positions are %v", broken)
+	}
+}